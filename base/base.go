@@ -1,61 +1,109 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package base
-
-import (
-	"github.com/funny/link"
-	"github.com/oikomi/gopush/protocol"
-)
-
-type ChannelMap map[string]*ChannelState
-type SessionMap map[string]*link.Session
-
-var ChannleList []string
-
-func init() {
-	ChannleList = []string{protocol.SYSCTRL_CLIENT_STATUS, protocol.SYSCTRL_TOPIC_STATUS, protocol.SYSCTRL_TOPIC_SYNC, 
-		protocol.SYSCTRL_SEND}
-}
-
-type ChannelState struct {
-	ChannelName   string
-	Channel       *link.Channel
-	ClientIDlist  []string
-}
-
-func NewChannelState(channelName string, channel *link.Channel) *ChannelState{
-	return &ChannelState {
-		ChannelName  : channelName,
-		Channel      : channel,
-		ClientIDlist : make([]string, 0),
-	}
-}
-
-type SessionState struct {
-	ClientID string
-	Alive    bool
-}
-
-func NewSessionState(alive bool, cid string) *SessionState {
-	return &SessionState {
-		ClientID : cid,
-		Alive    : alive,
-	}
-}
-
-type Config interface {
-	LoadConfig(configfile string) (*Config, error)
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package base
+
+import (
+	"time"
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/protocol"
+)
+
+type ChannelMap map[string]*ChannelState
+type SessionMap map[string]*link.Session
+type DeviceMap  map[string][]*link.Session
+
+var ChannleList []string
+
+func init() {
+	ChannleList = []string{protocol.SYSCTRL_CLIENT_STATUS, protocol.SYSCTRL_TOPIC_STATUS, protocol.SYSCTRL_TOPIC_SYNC, 
+		protocol.SYSCTRL_SEND}
+}
+
+type ChannelState struct {
+	ChannelName   string
+	Channel       *link.Channel
+	ClientIDlist  []string
+}
+
+func NewChannelState(channelName string, channel *link.Channel) *ChannelState{
+	return &ChannelState {
+		ChannelName  : channelName,
+		Channel      : channel,
+		ClientIDlist : make([]string, 0),
+	}
+}
+
+type SessionState struct {
+	ClientID string
+	Alive    bool
+}
+
+func NewSessionState(alive bool, cid string) *SessionState {
+	return &SessionState {
+		ClientID : cid,
+		Alive    : alive,
+	}
+}
+
+// PeerState is the state of a router or manager session that is allowed to
+// use the system channels.
+type PeerState struct {
+	UUID string
+}
+
+func NewPeerState(uuid string) *PeerState {
+	return &PeerState {
+		UUID : uuid,
+	}
+}
+
+// PeerNonceState is the state of a session that asked for a nonce to sign
+// its peer token with. The nonce is only good on this session.
+type PeerNonceState struct {
+	Nonce string
+}
+
+func NewPeerNonceState(nonce string) *PeerNonceState {
+	return &PeerNonceState {
+		Nonce : nonce,
+	}
+}
+
+type PendingMsgMap map[string]*PendingMsg
+
+type PendingMsg struct {
+	MsgID     string
+	FromID    string
+	ToID      string
+	Msg       string
+	Retries   int
+	LastSend  time.Time
+}
+
+func NewPendingMsg(msgID string, fromID string, toID string, msg string) *PendingMsg {
+	return &PendingMsg {
+		MsgID    : msgID,
+		FromID   : fromID,
+		ToID     : toID,
+		Msg      : msg,
+		Retries  : 0,
+		LastSend : time.Now(),
+	}
+}
+
+type Config interface {
+	LoadConfig(configfile string) (*Config, error)
 }
\ No newline at end of file
@@ -0,0 +1,299 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// gopush-bench logs in simulated clients through the gateway, sends P2P and
+// topic messages at a fixed rate and reports latency, throughput and loss.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"math/rand"
+	"github.com/golang/glog"
+	"github.com/oikomi/gopush/client"
+	"github.com/oikomi/gopush/common"
+	"github.com/oikomi/gopush/protocol"
+)
+
+const VERSION string = "0.10"
+
+func version() {
+	fmt.Printf("gopush-bench version %s Copyright (c) 2014 Harold Miao (miaohonghit@gmail.com)  \n", VERSION)
+}
+
+var InputConfFile = flag.String("conf_file", "bench.json", "input conf file name")   
+
+// The time a message is sent is carried in the message itself, so the
+// receiver can tell the delivery latency.
+var msgSeq uint64
+
+func newBenchMsg() string {
+	seq := atomic.AddUint64(&msgSeq, 1)
+	return strconv.FormatUint(seq, 10) + ":" + strconv.FormatInt(time.Now().UnixNano(), 10)
+}
+
+func parseBenchMsg(msg string) (string, time.Time, bool) {
+	parts := strings.SplitN(msg, ":", 2)
+	if len(parts) != 2 {
+		return "", time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return parts[0], time.Unix(0, ns), true
+}
+
+type BenchClient struct {
+	ID      string
+	Client  *client.Client
+	ready   chan bool
+	once    sync.Once
+}
+
+type Bench struct {
+	cfg       *BenchConfig
+	clientCfg client.Config
+	stats     *Stats
+	clients   []*BenchClient
+	topics    map[string][]*BenchClient
+}
+
+func NewBench(cfg *BenchConfig) *Bench {
+	return &Bench {
+		cfg       : cfg,
+		clientCfg : client.Config {
+			GatewayServer     : cfg.GatewayServer,
+			HeartBeatTime     : cfg.HeartBeatTime,
+			HeartBeatLimit    : cfg.HeartBeatLimit,
+			ReconnectInterval : cfg.ReconnectInterval,
+			TLS               : cfg.TLS,
+		},
+		stats     : NewStats(),
+		clients   : make([]*BenchClient, 0),
+		topics    : make(map[string][]*BenchClient),
+	}
+}
+
+// Log in as id. The client counts as connected when the msg_server answers
+// LIST_MY_TOPICS, which it only does after the login.
+func (self *Bench)connect(id string) *BenchClient {
+	bc := &BenchClient {
+		ID     : id,
+		Client : client.NewClient(&self.clientCfg),
+		ready  : make(chan bool),
+	}
+	start := time.Now()
+	
+	bc.Client.OnP2PMessage(func(msg string, fromID string, msgID string) {
+		seq, sentAt, ok := parseBenchMsg(msg)
+		if ok {
+			self.stats.addRecv("p:" + seq, false, sentAt)
+		}
+	})
+	bc.Client.OnTopicMessage(func(topicName string, msg string, fromID string) {
+		seq, sentAt, ok := parseBenchMsg(msg)
+		if ok {
+			self.stats.addRecv("t:" + bc.ID + ":" + seq, true, sentAt)
+		}
+	})
+	bc.Client.OnCmd(func(cmd *protocol.CmdSimple) {
+		if cmd.CmdName == protocol.RESP_LIST_MY_TOPICS_CMD {
+			bc.once.Do(func() {
+				self.stats.addConnect(time.Since(start))
+				close(bc.ready)
+			})
+		}
+	})
+	
+	token := ""
+	if self.cfg.AuthSecret != "" {
+		token = common.NewToken(self.cfg.AuthSecret, id, time.Hour)
+	}
+	err := bc.Client.Connect(id, token)
+	if err == nil {
+		err = bc.Client.Send(protocol.LIST_MY_TOPICS_CMD)
+	}
+	if err != nil {
+		glog.Error(err.Error())
+		self.stats.addConnectFailed()
+		return nil
+	}
+	
+	select {
+	case <-bc.ready:
+		return bc
+	case <-time.After(10 * time.Second):
+		glog.Warningf("%s login timeout", id)
+		self.stats.addConnectFailed()
+		bc.Client.Close()
+		return nil
+	}
+}
+
+func (self *Bench)connectAll() {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	
+	for i := 0; i < self.cfg.Clients; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			bc := self.connect(id)
+			if bc != nil {
+				mu.Lock()
+				self.clients = append(self.clients, bc)
+				mu.Unlock()
+			}
+		}(self.cfg.IDPrefix + strconv.Itoa(i))
+		if self.cfg.ConnectRate > 0 {
+			time.Sleep(time.Second / time.Duration(self.cfg.ConnectRate))
+		}
+	}
+	wg.Wait()
+}
+
+// Spread the clients over the topics. The first member of each topic
+// creates it and the rest join.
+func (self *Bench)setupTopics() {
+	if self.cfg.Topics <= 0 || self.cfg.TopicRate <= 0 {
+		return
+	}
+	run := strconv.FormatInt(time.Now().Unix(), 10)
+	for i, bc := range self.clients {
+		topicName := self.cfg.TopicPrefix + "_" + run + "_" + strconv.Itoa(i % self.cfg.Topics)
+		self.topics[topicName] = append(self.topics[topicName], bc)
+	}
+	
+	for topicName, members := range self.topics {
+		err := members[0].Client.CreateTopic(topicName)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+	time.Sleep(self.cfg.SetupWait * time.Second)
+	
+	for topicName, members := range self.topics {
+		for _, bc := range members[1:] {
+			err := bc.Client.JoinTopic(topicName)
+			if err != nil {
+				glog.Error(err.Error())
+			}
+		}
+	}
+	time.Sleep(self.cfg.SetupWait * time.Second)
+}
+
+func (self *Bench)sendP2P() {
+	from := self.clients[rand.Intn(len(self.clients))]
+	to := self.clients[rand.Intn(len(self.clients))]
+	msg := newBenchMsg()
+	err := from.Client.SendP2P(to.ID, msg)
+	if err != nil {
+		self.stats.addSendFailed()
+		return
+	}
+	self.stats.addP2PSent()
+}
+
+func (self *Bench)sendTopic(topicNames []string) {
+	topicName := topicNames[rand.Intn(len(topicNames))]
+	members := self.topics[topicName]
+	from := members[rand.Intn(len(members))]
+	msg := newBenchMsg()
+	err := from.Client.PublishTopic(topicName, msg)
+	if err != nil {
+		self.stats.addSendFailed()
+		return
+	}
+	self.stats.addTopicSent(len(members))
+}
+
+// Call send rate times a second until stop is closed.
+func (self *Bench)drive(rate int, stop chan bool, wg *sync.WaitGroup, send func()) {
+	defer wg.Done()
+	if rate <= 0 {
+		return
+	}
+	timer := time.NewTicker(time.Second / time.Duration(rate))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			send()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (self *Bench)Run() {
+	fmt.Printf("connecting %d clients...\n", self.cfg.Clients)
+	self.connectAll()
+	if len(self.clients) == 0 {
+		fmt.Println("no client connected")
+		return
+	}
+	self.setupTopics()
+	
+	topicNames := make([]string, 0)
+	for topicName := range self.topics {
+		topicNames = append(topicNames, topicName)
+	}
+	
+	fmt.Printf("sending for %d seconds...\n", self.cfg.Duration)
+	var wg sync.WaitGroup
+	stop := make(chan bool)
+	self.stats.markStart()
+	wg.Add(2)
+	go self.drive(self.cfg.P2PRate, stop, &wg, self.sendP2P)
+	go self.drive(self.cfg.TopicRate, stop, &wg, func() {
+		if len(topicNames) > 0 {
+			self.sendTopic(topicNames)
+		}
+	})
+	time.Sleep(self.cfg.Duration * time.Second)
+	close(stop)
+	wg.Wait()
+	self.stats.markStop()
+	
+	time.Sleep(self.cfg.DrainWait * time.Second)
+	self.stats.markEnd()
+	
+	for _, bc := range self.clients {
+		bc.Client.Close()
+	}
+}
+
+func main() {
+	version()
+	flag.Parse()
+	cfg := NewBenchConfig(*InputConfFile)
+	err := cfg.LoadConfig()
+	if err != nil {
+		glog.Error(err.Error())
+		return
+	}
+	
+	bench := NewBench(cfg)
+	bench.Run()
+	fmt.Print(bench.stats.Report())
+	glog.Flush()
+}
@@ -0,0 +1,77 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"encoding/json"
+	"time"
+	"github.com/golang/glog"
+	"github.com/oikomi/gopush/common"
+)
+
+type BenchConfig struct {
+	configfile         string
+	GatewayServer      string
+	TLS                common.TLSConfig
+	LogFile            string
+	AuthSecret         string
+	HeartBeatTime      time.Duration
+	HeartBeatLimit     uint64
+	ReconnectInterval  time.Duration
+	Clients            int
+	IDPrefix           string
+	ConnectRate        int
+	Topics             int
+	TopicPrefix        string
+	SetupWait          time.Duration
+	P2PRate            int
+	TopicRate          int
+	Duration           time.Duration
+	DrainWait          time.Duration
+}
+
+func NewBenchConfig(configfile string) *BenchConfig {
+	return &BenchConfig {
+		configfile        : configfile,
+		HeartBeatTime     : 10,
+		HeartBeatLimit    : 3,
+		ReconnectInterval : 5,
+		Clients           : 100,
+		IDPrefix          : "bench",
+		ConnectRate       : 100,
+		TopicPrefix       : "bench_topic",
+		SetupWait         : 2,
+		Duration          : 30,
+		DrainWait         : 5,
+	}
+}
+
+func (self *BenchConfig)LoadConfig() error {
+	file, err := os.Open(self.configfile)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(file)
+	err = dec.Decode(&self)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stats collects the numbers of one bench run.
+type Stats struct {
+	mu              sync.Mutex
+	connected       int
+	connectFailed   int
+	connectLatency  []time.Duration
+	p2pSent         int
+	p2pRecv         int
+	topicSent       int
+	topicExpected   int
+	topicRecv       int
+	duplicates      int
+	sendFailed      int
+	deliveryLatency []time.Duration
+	seen            map[string]bool
+	start           time.Time
+	stop            time.Time
+	end             time.Time
+}
+
+func NewStats() *Stats {
+	return &Stats {
+		connectLatency  : make([]time.Duration, 0),
+		deliveryLatency : make([]time.Duration, 0),
+		seen            : make(map[string]bool),
+	}
+}
+
+func (self *Stats)addConnect(d time.Duration) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.connected++
+	self.connectLatency = append(self.connectLatency, d)
+}
+
+func (self *Stats)addConnectFailed() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.connectFailed++
+}
+
+func (self *Stats)addSendFailed() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sendFailed++
+}
+
+func (self *Stats)addP2PSent() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.p2pSent++
+}
+
+func (self *Stats)addTopicSent(members int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.topicSent++
+	self.topicExpected += members
+}
+
+// Count a delivered message once per key. Resent messages are duplicates.
+func (self *Stats)addRecv(key string, topic bool, sentAt time.Time) {
+	d := time.Since(sentAt)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.seen[key] {
+		self.duplicates++
+		return
+	}
+	self.seen[key] = true
+	if topic {
+		self.topicRecv++
+	} else {
+		self.p2pRecv++
+	}
+	self.deliveryLatency = append(self.deliveryLatency, d)
+}
+
+func (self *Stats)markStart() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.start = time.Now()
+}
+
+func (self *Stats)markStop() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.stop = time.Now()
+}
+
+func (self *Stats)markEnd() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.end = time.Now()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted) - 1) * p)
+	return sorted[i]
+}
+
+func latencyLine(name string, l []time.Duration) string {
+	sorted := append([]time.Duration {}, l...)
+	sort.Sort(durations(sorted))
+	return fmt.Sprintf("%-18s p50 %-10v p90 %-10v p99 %-10v max %v", name, 
+		percentile(sorted, 0.5), percentile(sorted, 0.9), percentile(sorted, 0.99), percentile(sorted, 1))
+}
+
+func loss(recv int, expected int) float64 {
+	if expected == 0 {
+		return 0
+	}
+	return 100 * float64(expected - recv) / float64(expected)
+}
+
+func (self *Stats)Report() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	sending := self.stop.Sub(self.start).Seconds()
+	if sending <= 0 {
+		sending = 1
+	}
+	elapsed := self.end.Sub(self.start).Seconds()
+	if elapsed <= 0 {
+		elapsed = 1
+	}
+	
+	s := fmt.Sprintf("clients            %d connected, %d failed\n", self.connected, self.connectFailed)
+	s += latencyLine("connect latency", self.connectLatency) + "\n"
+	s += latencyLine("delivery latency", self.deliveryLatency) + "\n"
+	s += fmt.Sprintf("p2p                %d sent, %d delivered, %.2f%% loss\n", 
+		self.p2pSent, self.p2pRecv, loss(self.p2pRecv, self.p2pSent))
+	s += fmt.Sprintf("topic              %d sent, %d of %d delivered, %.2f%% loss\n", 
+		self.topicSent, self.topicRecv, self.topicExpected, loss(self.topicRecv, self.topicExpected))
+	s += fmt.Sprintf("throughput         %.1f sent/s, %.1f delivered/s\n", 
+		float64(self.p2pSent + self.topicSent) / sending, float64(self.p2pRecv + self.topicRecv) / elapsed)
+	s += fmt.Sprintf("errors             %d send failed, %d duplicates\n", self.sendFailed, self.duplicates)
+	
+	return s
+}
+
+type durations []time.Duration
+
+func (self durations)Len() int           { return len(self) }
+func (self durations)Less(i, j int) bool { return self[i] < self[j] }
+func (self durations)Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
@@ -0,0 +1,101 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+	"testing"
+)
+
+func TestPercentile(t *testing.T) {
+	ms := func(n ...int) []time.Duration {
+		l := make([]time.Duration, 0)
+		for _, i := range n {
+			l = append(l, time.Duration(i) * time.Millisecond)
+		}
+		return l
+	}
+	tests := []struct {
+		name   string
+		sorted []time.Duration
+		p      float64
+		want   time.Duration
+	}{
+		{"empty", nil, 0.5, 0},
+		{"one", ms(7), 0.99, 7 * time.Millisecond},
+		{"p0", ms(1, 2, 3, 4, 5), 0, 1 * time.Millisecond},
+		{"p50", ms(1, 2, 3, 4, 5), 0.5, 3 * time.Millisecond},
+		{"p90", ms(1, 2, 3, 4, 5, 6, 7, 8, 9, 10), 0.9, 9 * time.Millisecond},
+		{"max", ms(1, 2, 3, 4, 5), 1, 5 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		got := percentile(tt.sorted, tt.p)
+		if got != tt.want {
+			t.Errorf("%s: percentile = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoss(t *testing.T) {
+	tests := []struct {
+		name     string
+		recv     int
+		expected int
+		want     float64
+	}{
+		{"nothing expected", 0, 0, 0},
+		{"all delivered", 10, 10, 0},
+		{"half lost", 5, 10, 50},
+		{"all lost", 0, 4, 100},
+		{"quarter lost", 3, 4, 25},
+	}
+	for _, tt := range tests {
+		got := loss(tt.recv, tt.expected)
+		if got != tt.want {
+			t.Errorf("%s: loss = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAddRecv(t *testing.T) {
+	tests := []struct {
+		name  string
+		keys  []string
+		topic bool
+		recv  int
+		dups  int
+	}{
+		{"p2p once each", []string{"a", "b", "c"}, false, 3, 0},
+		{"p2p resent", []string{"a", "a", "b", "a"}, false, 2, 2},
+		{"topic resent", []string{"t1", "t1"}, true, 1, 1},
+	}
+	for _, tt := range tests {
+		s := NewStats()
+		for _, key := range tt.keys {
+			s.addRecv(key, tt.topic, time.Now())
+		}
+		recv := s.p2pRecv
+		if tt.topic {
+			recv = s.topicRecv
+		}
+		if recv != tt.recv || s.duplicates != tt.dups {
+			t.Errorf("%s: %d received, %d duplicates, want %d and %d", tt.name, recv, s.duplicates, tt.recv, tt.dups)
+		}
+		if len(s.deliveryLatency) != tt.recv {
+			t.Errorf("%s: %d latencies, want %d", tt.name, len(s.deliveryLatency), tt.recv)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package client is the Go SDK of gopush. A Client asks the gateway for a
+// msg_server, logs in with its ID, keeps the connection alive with a
+// heartbeat and reconnects through the gateway when the msg_server is lost.
+package client
+
+import (
+	"sync"
+	"time"
+	"encoding/json"
+	"github.com/funny/link"
+	"github.com/golang/glog"
+	"github.com/oikomi/gopush/protocol"
+	"github.com/oikomi/gopush/common"
+)
+
+type Client struct {
+	cfg               *Config
+	protocol          link.PacketProtocol
+	id                string
+	token             string
+	mu                sync.Mutex
+	session           *link.Session
+	hb                *common.HeartBeat
+	closed            bool
+
+	p2pHandler        func(msg string, fromID string, msgID string)
+	topicHandler      func(topicName string, msg string, fromID string)
+	reportHandler     func(msgID string, toID string, status string)
+	movedHandler      func(topicName string, addr string)
+	cmdHandler        func(cmd *protocol.CmdSimple)
+	disconnectHandler func(err error)
+}
+
+func NewClient(cfg *Config) *Client {
+	return &Client {
+		cfg      : cfg,
+		protocol : link.PacketN(2, link.BigEndianBO, link.LittleEndianBF),
+	}
+}
+
+// OnP2PMessage sets the handler of P2P messages. They are acked after the
+// handler returns.
+func (self *Client)OnP2PMessage(f func(msg string, fromID string, msgID string)) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.p2pHandler = f
+}
+
+// OnTopicMessage sets the handler of topic messages.
+func (self *Client)OnTopicMessage(f func(topicName string, msg string, fromID string)) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.topicHandler = f
+}
+
+// OnDeliveryReport sets the handler of the delivery reports of sent P2P
+// messages.
+func (self *Client)OnDeliveryReport(f func(msgID string, toID string, status string)) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.reportHandler = f
+}
+
+// OnTopicMoved sets the handler called when a topic is taken over by the
+// msg_server at addr. The client stays where it is, the topic host only
+// matters to the msg_servers.
+func (self *Client)OnTopicMoved(f func(topicName string, addr string)) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.movedHandler = f
+}
+
+// OnCmd sets the handler of every other command from the msg_server, like
+// topic results and presence notices.
+func (self *Client)OnCmd(f func(cmd *protocol.CmdSimple)) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.cmdHandler = f
+}
+
+// OnDisconnect sets the handler called when the client gives up the
+// connection for good, after AUTH_FAILED or KICKED. The error is a
+// *RejectedError.
+func (self *Client)OnDisconnect(f func(err error)) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.disconnectHandler = f
+}
+
+// Connect logs in as id with its token, signed with the AuthSecret of the
+// msg_servers. The gateway may renew the token on every connect. It returns
+// once the msg_server accepted the login, or a *RejectedError if the
+// msg_server answered with AUTH_FAILED or KICKED.
+func (self *Client)Connect(id string, token string) error {
+	self.mu.Lock()
+	self.id = id
+	self.token = token
+	self.closed = false
+	self.mu.Unlock()
+	
+	addr, err := self.locate()
+	if err != nil {
+		return err
+	}
+	
+	return self.connectMsgServer(addr)
+}
+
+// Close the connection. The client does not reconnect after Close.
+func (self *Client)Close() {
+	self.mu.Lock()
+	self.closed = true
+	session := self.session
+	self.session = nil
+	self.mu.Unlock()
+	
+	if session != nil {
+		session.Close(nil)
+	}
+}
+
+// Ask the gateway for the msg_server of the client. The token renewed by
+// the gateway replaces the old one.
+func (self *Client)locate() (string, error) {
+	gatewayClient, err := common.Dial("tcp", self.cfg.GatewayServer, &self.cfg.TLS, self.protocol)
+	if err != nil {
+		return "", err
+	}
+	defer gatewayClient.Close(nil)
+	
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = protocol.SEND_CLIENT_ID_CMD
+	self.mu.Lock()
+	cmd.Args = append(cmd.Args, self.id)
+	if self.token != "" {
+		cmd.Args = append(cmd.Args, self.token)
+	}
+	self.mu.Unlock()
+	
+	err = gatewayClient.Send(link.JSON {
+		cmd,
+	})
+	if err != nil {
+		return "", err
+	}
+	
+	// the token follows the address, a gateway which hangs before either
+	// must not block the client
+	err = gatewayClient.Conn().SetReadDeadline(time.Now().Add(self.cfg.HeartBeatTime * time.Second))
+	if err != nil {
+		return "", err
+	}
+	inMsg, err := gatewayClient.Read()
+	if err != nil {
+		return "", err
+	}
+	addr := string(inMsg.Get())
+	glog.Info(addr)
+	
+	tokenMsg, err := gatewayClient.Read()
+	if err == nil {
+		self.mu.Lock()
+		self.token = string(tokenMsg.Get())
+		self.mu.Unlock()
+	}
+	
+	return addr, nil
+}
+
+// Dial the msg_server, log in and start the heartbeat and the read loop.
+func (self *Client)connectMsgServer(addr string) error {
+	session, err := common.Dial("tcp", addr, &self.cfg.TLS, self.protocol)
+	if err != nil {
+		return err
+	}
+	
+	err = self.login(session)
+	if err != nil {
+		session.Close(nil)
+		return err
+	}
+	
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		session.Close(nil)
+		return CLIENTCLOSED
+	}
+	old := self.session
+	self.session = session
+	self.hb = common.NewHeartBeat("client", session, self.cfg.HeartBeatTime, self.cfg.HeartBeatLimit)
+	hb := self.hb
+	self.mu.Unlock()
+	
+	if old != nil {
+		old.Close(nil)
+	}
+	
+	go hb.Beat()
+	go self.readLoop(session)
+	
+	return nil
+}
+
+// Send the client ID and wait a heartbeat for the msg_server to accept it.
+func (self *Client)login(session *link.Session) error {
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = protocol.SEND_CLIENT_ID_CMD
+	self.mu.Lock()
+	cmd.Args = append(cmd.Args, self.id)
+	cmd.Args = append(cmd.Args, self.token)
+	self.mu.Unlock()
+	
+	err := session.Send(link.JSON {
+		cmd,
+	})
+	if err != nil {
+		return err
+	}
+	
+	err = session.Conn().SetReadDeadline(time.Now().Add(self.cfg.HeartBeatTime * time.Second))
+	if err != nil {
+		return err
+	}
+	msg, err := session.Read()
+	if err != nil {
+		return err
+	}
+	var c protocol.CmdSimple
+	err = json.Unmarshal(msg.Get(), &c)
+	if err != nil {
+		return err
+	}
+	
+	switch c.CmdName {
+		case protocol.RESP_CLIENT_ID_CMD:
+			return session.Conn().SetReadDeadline(time.Time{})
+		case protocol.AUTH_FAILED_CMD, protocol.KICKED_CMD:
+			return rejected(&c)
+	}
+	return BADLOGINREPLY
+}
+
+func rejected(c *protocol.CmdSimple) *RejectedError {
+	reason := c.CmdName
+	if len(c.Args) > 0 {
+		reason = c.Args[0]
+	}
+	return &RejectedError {
+		CmdName : c.CmdName,
+		Reason  : reason,
+	}
+}
+
+func (self *Client)readLoop(session *link.Session) {
+	session.ReadLoop(func(msg link.InBuffer) {
+		var c protocol.CmdSimple
+		err := json.Unmarshal(msg.Get(), &c)
+		if err != nil {
+			glog.Error("error:", err)
+			return
+		}
+		self.dispatch(session, &c)
+	})
+	session.Close(nil)
+	
+	self.mu.Lock()
+	lost := !self.closed && self.session == session
+	self.mu.Unlock()
+	if lost {
+		glog.Warning("lost msg_server, reconnect...")
+		self.reconnect()
+	}
+}
+
+// Log in again through the gateway until it works or the client is closed.
+func (self *Client)reconnect() {
+	for {
+		time.Sleep(self.cfg.ReconnectInterval * time.Second)
+		self.mu.Lock()
+		closed := self.closed
+		self.mu.Unlock()
+		if closed {
+			return
+		}
+		
+		addr, err := self.locate()
+		if err == nil {
+			err = self.connectMsgServer(addr)
+		}
+		if err == nil {
+			return
+		}
+		if rerr, ok := err.(*RejectedError); ok {
+			self.fail(rerr)
+			return
+		}
+		glog.Error(err.Error())
+	}
+}
+
+// Give up the connection and tell the disconnect handler why.
+func (self *Client)fail(err *RejectedError) {
+	self.Close()
+	
+	self.mu.Lock()
+	f := self.disconnectHandler
+	self.mu.Unlock()
+	if f != nil {
+		f(err)
+	}
+}
+
+func (self *Client)dispatch(session *link.Session, c *protocol.CmdSimple) {
+	self.mu.Lock()
+	hb := self.hb
+	p2pHandler := self.p2pHandler
+	topicHandler := self.topicHandler
+	reportHandler := self.reportHandler
+	movedHandler := self.movedHandler
+	cmdHandler := self.cmdHandler
+	self.mu.Unlock()
+	
+	switch c.CmdName {
+		case protocol.RESP_PING_CMD:
+			if hb != nil {
+				hb.Receive()
+			}
+		case protocol.RESP_MESSAGE_P2P_CMD:
+			if len(c.Args) < 3 {
+				return
+			}
+			if p2pHandler != nil {
+				p2pHandler(c.Args[0], c.Args[1], c.Args[2])
+			}
+			ack := protocol.NewCmdSimple()
+			ack.CmdName = protocol.ACK_MESSAGE_CMD
+			ack.Args = append(ack.Args, c.Args[2])
+			
+			err := session.Send(link.JSON {
+				ack,
+			})
+			if err != nil {
+				glog.Error(err.Error())
+			}
+		case protocol.RESP_MESSAGE_TOPIC_CMD:
+			if len(c.Args) < 3 {
+				return
+			}
+			if topicHandler != nil {
+				topicHandler(c.Args[0], c.Args[1], c.Args[2])
+			}
+		case protocol.DELIVERY_REPORT_CMD:
+			if len(c.Args) < 3 {
+				return
+			}
+			if reportHandler != nil {
+				reportHandler(c.Args[0], c.Args[1], c.Args[2])
+			}
+		case protocol.TOPIC_MOVED_CMD:
+			if len(c.Args) < 2 {
+				return
+			}
+			if movedHandler != nil {
+				movedHandler(c.Args[0], c.Args[1])
+			}
+		case protocol.AUTH_FAILED_CMD, protocol.KICKED_CMD:
+			self.fail(rejected(c))
+		default:
+			if cmdHandler != nil {
+				cmdHandler(c)
+			}
+	}
+}
+
+func (self *Client)send(cmd *protocol.CmdSimple) error {
+	self.mu.Lock()
+	session := self.session
+	self.mu.Unlock()
+	if session == nil {
+		return NOTCONNECTED
+	}
+	
+	return session.Send(link.JSON {
+		cmd,
+	})
+}
+
+// Send sends any command to the msg_server.
+func (self *Client)Send(cmdName string, args ...string) error {
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = cmdName
+	cmd.Args = append(cmd.Args, args...)
+	
+	return self.send(cmd)
+}
+
+func (self *Client)SendP2P(send2ID string, msg string) error {
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = protocol.SEND_MESSAGE_P2P_CMD
+	cmd.Args = append(cmd.Args, send2ID)
+	cmd.Args = append(cmd.Args, msg)
+	
+	return self.send(cmd)
+}
+
+func (self *Client)CreateTopic(topicName string) error {
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = protocol.CREATE_TOPIC_CMD
+	cmd.Args = append(cmd.Args, topicName)
+	
+	return self.send(cmd)
+}
+
+func (self *Client)JoinTopic(topicName string) error {
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = protocol.JOIN_TOPIC_CMD
+	cmd.Args = append(cmd.Args, topicName)
+	
+	return self.send(cmd)
+}
+
+func (self *Client)PublishTopic(topicName string, msg string) error {
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = protocol.SEND_MESSAGE_TOPIC_CMD
+	cmd.Args = append(cmd.Args, topicName)
+	cmd.Args = append(cmd.Args, msg)
+	
+	return self.send(cmd)
+}
@@ -13,27 +13,30 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package main
+package client
 
 import (
 	"os"
 	"time"
 	"encoding/json"
-	"log"
+	"github.com/oikomi/gopush/common"
 )
 
+// Config tells a Client where the gateway is and how to keep the connection
+// to its msg_server alive.
 type Config struct {
 	TransportProtocols string
 	LogFile            string
 	GatewayServer      string
 	HeartBeatTime      time.Duration
-	Expire             time.Duration
+	HeartBeatLimit     uint64
+	ReconnectInterval  time.Duration
+	TLS                common.TLSConfig
 }
 
 func LoadConfig(configfile string) (cfg Config, err error) {
 	file, err := os.Open(configfile)
 	if err != nil {
-		log.Fatalln("Open configfile failed")
 		return
 	}
 	defer file.Close()
@@ -0,0 +1,37 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+)
+
+var (
+	NOTCONNECTED = errors.New("NOT CONNECTED")
+	CLIENTCLOSED = errors.New("CLIENT CLOSED")
+	BADLOGINREPLY = errors.New("BAD LOGIN REPLY")
+)
+
+// RejectedError is why the msg_server sent the client away with AUTH_FAILED
+// or KICKED.
+type RejectedError struct {
+	CmdName string
+	Reason  string
+}
+
+func (self *RejectedError)Error() string {
+	return self.CmdName + " : " + self.Reason
+}
@@ -1,94 +1,93 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package common
-
-import (
-	"sync"
-	"time"
-	"github.com/golang/glog"
-	"github.com/oikomi/gopush/protocol"
-	"github.com/funny/link"
-)
-
-type HeartBeat struct {
-	name       string
-	session    *link.Session
-	mu         sync.Mutex
-	timeout    time.Duration
-	expire     time.Duration
-	fails      uint64
-	threshold  uint64
-}
-
-func NewHeartBeat(name string, session *link.Session, timeout time.Duration, expire time.Duration, limit uint64) *HeartBeat {
-	return &HeartBeat {
-		name      : name,
-		session   : session,
-		timeout   : timeout,
-		expire    : expire,
-		threshold : limit,
-	}
-}
-
-func (self *HeartBeat) ResetFailures() {
-	self.mu.Lock()
-	defer self.mu.Unlock()
-	self.fails = 0
-}
-
-func (self *HeartBeat) ChangeThreshold(thres uint64) {
-	self.mu.Lock()
-	defer self.mu.Unlock()
-	self.threshold = thres
-}
-
-func (self *HeartBeat) Beat() {
-	timer := time.NewTicker(self.timeout * time.Second)
-	ttl := time.After(self.expire * time.Second)
-	for {
-		select {
-		case <-timer.C:
-			go func() {
-				cmd := protocol.NewCmdSimple()
-				cmd.CmdName = protocol.SEND_PING_CMD
-				cmd.Args = append(cmd.Args, protocol.PING)
-				
-				err := self.session.Send(link.JSON {
-					cmd,
-				})
-				if err != nil {
-					glog.Error(err.Error())
-				}
-			}()
-		case <-ttl:
-			break
-		}
-	}
-}
-
-func (self *HeartBeat) Receive() {
-	timeout := time.After(self.timeout)
-	for {
-		select {
-		case <-timeout:
-			self.fails = self.fails + 1
-			if self.fails > self.threshold {
-				return
-			}
-		}
-	}
-}
-
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"sync"
+	"time"
+	"github.com/golang/glog"
+	"github.com/oikomi/gopush/protocol"
+	"github.com/funny/link"
+)
+
+type HeartBeat struct {
+	name       string
+	session    *link.Session
+	mu         sync.Mutex
+	timeout    time.Duration
+	fails      uint64
+	threshold  uint64
+}
+
+func NewHeartBeat(name string, session *link.Session, timeout time.Duration, limit uint64) *HeartBeat {
+	return &HeartBeat {
+		name      : name,
+		session   : session,
+		timeout   : timeout,
+		threshold : limit,
+	}
+}
+
+func (self *HeartBeat) ResetFailures() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.fails = 0
+}
+
+func (self *HeartBeat) ChangeThreshold(thres uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.threshold = thres
+}
+
+// Ping the peer every timeout seconds until the session is closed. The
+// session is closed when more than threshold pings in a row are not answered.
+func (self *HeartBeat) Beat() {
+	timer := time.NewTicker(self.timeout * time.Second)
+	defer timer.Stop()
+	for {
+		<-timer.C
+		if self.session.IsClosed() {
+			return
+		}
+		
+		self.mu.Lock()
+		self.fails = self.fails + 1
+		dead := self.fails > self.threshold
+		self.mu.Unlock()
+		if dead {
+			glog.Warningf("%s heartbeat lost", self.name)
+			self.session.Close(nil)
+			return
+		}
+		
+		cmd := protocol.NewCmdSimple()
+		cmd.CmdName = protocol.SEND_PING_CMD
+		cmd.Args = append(cmd.Args, protocol.PING)
+		
+		err := self.session.Send(link.JSON {
+			cmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+}
+
+// Receive is called with every pong from the peer.
+func (self *HeartBeat) Receive() {
+	self.ResetFailures()
+}
@@ -0,0 +1,64 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"time"
+	"errors"
+	"encoding/json"
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/protocol"
+)
+
+var (
+	ErrBadPeerNonce = errors.New("bad peer nonce reply")
+)
+
+// PeerToken asks the msg_server on session for a nonce and returns a peer
+// token for uuid signed over it. The token is only good on this session, so
+// it can not be replayed on another link. It must be called before the read
+// loop of session is started.
+func PeerToken(session *link.Session, secret string, uuid string) (string, error) {
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = protocol.PEER_NONCE_CMD
+	err := session.Send(link.JSON {
+		cmd,
+	})
+	if err != nil {
+		return "", err
+	}
+	
+	msg, err := session.Read()
+	if err != nil {
+		return "", err
+	}
+	var c protocol.CmdSimple
+	err = json.Unmarshal(msg.Get(), &c)
+	if err != nil {
+		return "", err
+	}
+	if c.CmdName != protocol.RESP_PEER_NONCE_CMD || len(c.Args) < 1 {
+		return "", ErrBadPeerNonce
+	}
+	
+	return NewToken(secret, PeerTokenID(uuid, c.Args[0]), time.Minute), nil
+}
+
+// PeerTokenID is what a peer token of uuid is issued for on the session
+// that handed out nonce.
+func PeerTokenID(uuid string, nonce string) string {
+	return uuid + ":" + nonce
+}
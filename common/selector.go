@@ -0,0 +1,183 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"sort"
+	"sync"
+	"strconv"
+	"strings"
+	"hash/crc32"
+	"github.com/oikomi/gopush/storage"
+)
+
+const (
+	SELECT_RANDOM               = "random"
+	SELECT_LEAST_CONN           = "least_conn"
+	SELECT_WEIGHTED_ROUND_ROBIN = "weighted_round_robin"
+	SELECT_CONSISTENT_HASH      = "consistent_hash"
+)
+
+// ServerSelector picks the msg_server a client should connect to.
+type ServerSelector interface {
+	Select(serverList []*storage.MsgServerStoreData, clientID string) string
+}
+
+func NewServerSelector(strategy string) ServerSelector {
+	switch strategy {
+		case SELECT_LEAST_CONN:
+			return NewLeastConnSelector()
+		case SELECT_WEIGHTED_ROUND_ROBIN:
+			return NewWeightedRoundRobinSelector()
+		case SELECT_CONSISTENT_HASH:
+			return NewConsistentHashSelector(100)
+	}
+	
+	return NewRandomSelector()
+}
+
+type RandomSelector struct {
+}
+
+func NewRandomSelector() *RandomSelector {
+	return &RandomSelector {}
+}
+
+func (self *RandomSelector)Select(serverList []*storage.MsgServerStoreData, clientID string) string {
+	addrs := make([]string, 0)
+	for _, ms := range serverList {
+		addrs = append(addrs, ms.MsgServerAddr)
+	}
+	
+	return SelectServer(addrs, len(addrs))
+}
+
+// LeastConnSelector picks the msg_server with the fewest sessions, as
+// reported in the msg_server registry.
+type LeastConnSelector struct {
+}
+
+func NewLeastConnSelector() *LeastConnSelector {
+	return &LeastConnSelector {}
+}
+
+func (self *LeastConnSelector)Select(serverList []*storage.MsgServerStoreData, clientID string) string {
+	var best *storage.MsgServerStoreData
+	for _, ms := range serverList {
+		if best == nil || ms.SessionNum < best.SessionNum {
+			best = ms
+		}
+	}
+	
+	return best.MsgServerAddr
+}
+
+// WeightedRoundRobinSelector is the smooth weighted round-robin: each
+// msg_server is picked Weight times in every round, spread over the round.
+type WeightedRoundRobinSelector struct {
+	currentWeight  map[string]int
+	mutex          sync.Mutex
+}
+
+func NewWeightedRoundRobinSelector() *WeightedRoundRobinSelector {
+	return &WeightedRoundRobinSelector {
+		currentWeight : make(map[string]int),
+	}
+}
+
+func (self *WeightedRoundRobinSelector)Select(serverList []*storage.MsgServerStoreData, clientID string) string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	total := 0
+	var best *storage.MsgServerStoreData
+	for _, ms := range serverList {
+		weight := ms.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		total = total + weight
+		self.currentWeight[ms.MsgServerAddr] = self.currentWeight[ms.MsgServerAddr] + weight
+		if best == nil || self.currentWeight[ms.MsgServerAddr] > self.currentWeight[best.MsgServerAddr] {
+			best = ms
+		}
+	}
+	self.currentWeight[best.MsgServerAddr] = self.currentWeight[best.MsgServerAddr] - total
+	
+	return best.MsgServerAddr
+}
+
+// ConsistentHashSelector maps a client ID onto a hash ring of the msg_servers,
+// so a reconnecting client lands on the same msg_server as long as it is up.
+type ConsistentHashSelector struct {
+	replicas   int
+	ringKey    string
+	ring       []uint32
+	ringAddrs  map[uint32]string
+	mutex      sync.Mutex
+}
+
+func NewConsistentHashSelector(replicas int) *ConsistentHashSelector {
+	return &ConsistentHashSelector {
+		replicas  : replicas,
+		ring      : make([]uint32, 0),
+		ringAddrs : make(map[uint32]string),
+	}
+}
+
+func (self *ConsistentHashSelector)buildRing(addrs []string) {
+	ringKey := strings.Join(addrs, ",")
+	if ringKey == self.ringKey {
+		return
+	}
+	self.ringKey = ringKey
+	self.ring = make([]uint32, 0)
+	self.ringAddrs = make(map[uint32]string)
+	for _, addr := range addrs {
+		for i := 0; i < self.replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i)))
+			self.ring = append(self.ring, h)
+			self.ringAddrs[h] = addr
+		}
+	}
+	sort.Sort(uint32Slice(self.ring))
+}
+
+func (self *ConsistentHashSelector)Select(serverList []*storage.MsgServerStoreData, clientID string) string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	addrs := make([]string, 0)
+	for _, ms := range serverList {
+		addrs = append(addrs, ms.MsgServerAddr)
+	}
+	sort.Strings(addrs)
+	self.buildRing(addrs)
+	
+	h := crc32.ChecksumIEEE([]byte(clientID))
+	i := sort.Search(len(self.ring), func(i int) bool {
+		return self.ring[i] >= h
+	})
+	if i == len(self.ring) {
+		i = 0
+	}
+	
+	return self.ringAddrs[self.ring[i]]
+}
+
+type uint32Slice []uint32
+
+func (self uint32Slice) Len() int           { return len(self) }
+func (self uint32Slice) Less(i, j int) bool { return self[i] < self[j] }
+func (self uint32Slice) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
@@ -0,0 +1,152 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"github.com/oikomi/gopush/storage"
+)
+
+func msgServers(sessions []int, weights []int) []*storage.MsgServerStoreData {
+	list := make([]*storage.MsgServerStoreData, 0)
+	for i := range sessions {
+		list = append(list, storage.NewMsgServerStoreData("ms" + strconv.Itoa(i), sessions[i], 0, weights[i]))
+	}
+	return list
+}
+
+func TestNewServerSelector(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     string
+	}{
+		{SELECT_RANDOM, "*common.RandomSelector"},
+		{SELECT_LEAST_CONN, "*common.LeastConnSelector"},
+		{SELECT_WEIGHTED_ROUND_ROBIN, "*common.WeightedRoundRobinSelector"},
+		{SELECT_CONSISTENT_HASH, "*common.ConsistentHashSelector"},
+		{"", "*common.RandomSelector"},
+		{"unknown", "*common.RandomSelector"},
+	}
+	for _, tt := range tests {
+		got := fmt.Sprintf("%T", NewServerSelector(tt.strategy))
+		if got != tt.want {
+			t.Errorf("NewServerSelector(%q) = %s, want %s", tt.strategy, got, tt.want)
+		}
+	}
+}
+
+func TestRandomSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions []int
+	}{
+		{"one", []int{0}},
+		{"three", []int{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		list := msgServers(tt.sessions, make([]int, len(tt.sessions)))
+		s := NewRandomSelector()
+		for i := 0; i < 100; i++ {
+			got := s.Select(list, "alice")
+			found := false
+			for _, ms := range list {
+				found = found || ms.MsgServerAddr == got
+			}
+			if !found {
+				t.Errorf("%s: Select = %s, not in the list", tt.name, got)
+			}
+		}
+	}
+}
+
+func TestLeastConnSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		sessions []int
+		want     string
+	}{
+		{"one", []int{7}, "ms0"},
+		{"first least", []int{1, 5, 3}, "ms0"},
+		{"last least", []int{5, 3, 1}, "ms2"},
+		{"tie takes first", []int{4, 2, 2}, "ms1"},
+	}
+	for _, tt := range tests {
+		got := NewLeastConnSelector().Select(msgServers(tt.sessions, make([]int, len(tt.sessions))), "alice")
+		if got != tt.want {
+			t.Errorf("%s: Select = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWeightedRoundRobinSelector(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		want    []string
+	}{
+		{"equal", []int{1, 1, 1}, []string{"ms0", "ms1", "ms2"}},
+		{"smooth", []int{5, 1, 1}, []string{"ms0", "ms0", "ms1", "ms0", "ms2", "ms0", "ms0"}},
+		{"zero weight counts as one", []int{2, 0}, []string{"ms0", "ms1", "ms0"}},
+	}
+	for _, tt := range tests {
+		list := msgServers(make([]int, len(tt.weights)), tt.weights)
+		s := NewWeightedRoundRobinSelector()
+		// two rounds, the second one must repeat the first
+		for round := 0; round < 2; round++ {
+			for i, want := range tt.want {
+				got := s.Select(list, "alice")
+				if got != want {
+					t.Errorf("%s: round %d pick %d = %s, want %s", tt.name, round, i, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestConsistentHashSelector(t *testing.T) {
+	list := msgServers([]int{0, 0, 0, 0}, []int{1, 1, 1, 1})
+	s := NewConsistentHashSelector(100)
+	tests := []string{"alice", "bob", "carol", "dave", "eve"}
+	for _, id := range tests {
+		got := s.Select(list, id)
+		if again := s.Select(list, id); again != got {
+			t.Errorf("%s: Select = %s then %s", id, got, again)
+		}
+		
+		// the order of the registry does not matter
+		reversed := make([]*storage.MsgServerStoreData, 0)
+		for i := len(list) - 1; i >= 0; i-- {
+			reversed = append(reversed, list[i])
+		}
+		if other := NewConsistentHashSelector(100).Select(reversed, id); other != got {
+			t.Errorf("%s: Select on reversed list = %s, want %s", id, other, got)
+		}
+		
+		// losing another msg_server does not move the client
+		rest := make([]*storage.MsgServerStoreData, 0)
+		for _, ms := range list {
+			if ms.MsgServerAddr != got && len(rest) < len(list) - 2 {
+				rest = append(rest, ms)
+			}
+		}
+		rest = append(rest, storage.NewMsgServerStoreData(got, 0, 0, 1))
+		if after := s.Select(rest, id); after != got {
+			t.Errorf("%s: Select after a msg_server left = %s, want %s", id, after, got)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net"
+	"errors"
+	"sync/atomic"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/funny/link"
+)
+
+var (
+	ErrBadCAFile   = errors.New("no certificate found in CA file")
+	ErrNoPeerCert  = errors.New("no verified peer certificate")
+	ErrBadPeerName = errors.New("peer certificate name not allowed")
+)
+
+const (
+	CLIENT_AUTH_NONE            = "none"
+	CLIENT_AUTH_VERIFY_IF_GIVEN = "verify_if_given"
+	CLIENT_AUTH_REQUIRE         = "require"
+)
+
+// TLSConfig is the TLS section of the component configs. On a listener,
+// CAFile and ClientAuth turn on mutual TLS. On a dialer, CAFile verifies the
+// server and CertFile/KeyFile are presented to it.
+type TLSConfig struct {
+	Enable             bool
+	CertFile           string
+	KeyFile            string
+	CAFile             string
+	ClientAuth         string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+var dialSessionId uint64
+
+func loadCAPool(caFile string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, ErrBadCAFile
+	}
+	return pool, nil
+}
+
+func NewServerTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config {
+		Certificates : []tls.Certificate{cert},
+	}
+	if cfg.CAFile != "" {
+		tlsConfig.ClientCAs, err = loadCAPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch cfg.ClientAuth {
+		case CLIENT_AUTH_VERIFY_IF_GIVEN:
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		case CLIENT_AUTH_REQUIRE:
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func NewClientTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	var err error
+	tlsConfig := &tls.Config {
+		ServerName         : cfg.ServerName,
+		InsecureSkipVerify : cfg.InsecureSkipVerify,
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if cfg.CAFile != "" {
+		tlsConfig.RootCAs, err = loadCAPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// VerifyPeerName completes the TLS handshake on conn and checks that the
+// verified client certificate is issued to one of names, by its common name
+// or one of its DNS names.
+func VerifyPeerName(conn net.Conn, names []string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ErrNoPeerCert
+	}
+	err := tlsConn.Handshake()
+	if err != nil {
+		return err
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return ErrNoPeerCert
+	}
+	cert := chains[0][0]
+	for _, name := range names {
+		if cert.Subject.CommonName == name {
+			return nil
+		}
+		for _, dnsName := range cert.DNSNames {
+			if dnsName == name {
+				return nil
+			}
+		}
+	}
+	return ErrBadPeerName
+}
+
+// Listen is link.Listen with optional TLS.
+func Listen(network string, address string, cfg *TLSConfig, protocol link.PacketProtocol) (*link.Server, error) {
+	if cfg == nil || !cfg.Enable {
+		return link.Listen(network, address, protocol)
+	}
+	tlsConfig, err := NewServerTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen(network, address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return link.NewServer(listener, protocol), nil
+}
+
+// Dial is link.Dial with optional TLS.
+func Dial(network string, address string, cfg *TLSConfig, protocol link.PacketProtocol) (*link.Session, error) {
+	if cfg == nil || !cfg.Enable {
+		return link.Dial(network, address, protocol)
+	}
+	tlsConfig, err := NewClientTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := tls.Dial(network, address, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return link.NewSession(atomic.AddUint64(&dialSessionId, 1), conn, protocol), nil
+}
@@ -0,0 +1,78 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"time"
+	"errors"
+	"strings"
+	"strconv"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+var (
+	ErrBadToken     = errors.New("bad token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// NewNonce returns a random hex string for a peer to sign its token with.
+// A nonce is never made up when the system has no randomness to give.
+func NewNonce() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func signToken(secret string, clientID string, expireAt string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(clientID + ":" + expireAt))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewToken issues a token binding clientID to an expiry, signed with secret.
+// The token looks like "<expire unix time>:<hex HMAC-SHA256>".
+func NewToken(secret string, clientID string, expire time.Duration) string {
+	expireAt := strconv.FormatInt(time.Now().Add(expire).Unix(), 10)
+	return expireAt + ":" + signToken(secret, clientID, expireAt)
+}
+
+// VerifyToken checks that token was issued for clientID with secret and has
+// not expired yet.
+func VerifyToken(secret string, clientID string, token string) error {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 {
+		return ErrBadToken
+	}
+	expireAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return ErrBadToken
+	}
+	sig := signToken(secret, clientID, parts[0])
+	if !hmac.Equal([]byte(sig), []byte(parts[1])) {
+		return ErrBadToken
+	}
+	if time.Now().Unix() > expireAt {
+		return ErrTokenExpired
+	}
+	
+	return nil
+}
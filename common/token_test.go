@@ -0,0 +1,53 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"time"
+	"strings"
+	"testing"
+)
+
+func TestVerifyToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		secret   string
+		clientID string
+		token    string
+		err      error
+	}{
+		{"valid", "secret", "alice", NewToken("secret", "alice", time.Minute), nil},
+		{"other client", "secret", "bob", NewToken("secret", "alice", time.Minute), ErrBadToken},
+		{"other secret", "other", "alice", NewToken("secret", "alice", time.Minute), ErrBadToken},
+		{"expired", "secret", "alice", NewToken("secret", "alice", -time.Minute), ErrTokenExpired},
+		{"empty", "secret", "alice", "", ErrBadToken},
+		{"no signature", "secret", "alice", "12345", ErrBadToken},
+		{"bad expiry", "secret", "alice", "soon:" + signToken("secret", "alice", "soon"), ErrBadToken},
+		{"forged expiry", "secret", "alice", forgeExpiry(NewToken("secret", "alice", -time.Minute)), ErrBadToken},
+	}
+	for _, tt := range tests {
+		err := VerifyToken(tt.secret, tt.clientID, tt.token)
+		if err != tt.err {
+			t.Errorf("%s: VerifyToken = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+// Push the expiry of token far forward and keep its signature.
+func forgeExpiry(token string) string {
+	parts := strings.SplitN(token, ":", 2)
+	return "9999999999:" + parts[1]
+}
@@ -1,83 +1,103 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package common
-
-import (
-	"time"
-	"math/rand"
-	"github.com/golang/glog"
-	"github.com/oikomi/gopush/storage"
-)
-
-const KeyPrefix string = "push"
-
-var DefaultRedisConnectTimeout uint32 = 2000
-var DefaultRedisReadTimeout    uint32 = 1000
-var DefaultRedisWriteTimeout   uint32 = 1000
-
-var DefaultRedisOptions storage.RedisStoreOptions = storage.RedisStoreOptions {
-	Network        : "tcp",
-	Address        : ":6379",
-	ConnectTimeout : time.Duration(DefaultRedisConnectTimeout)*time.Millisecond,
-	ReadTimeout    : time.Duration(DefaultRedisReadTimeout)*time.Millisecond,
-	WriteTimeout   : time.Duration(DefaultRedisWriteTimeout)*time.Millisecond,
-	Database       : 1,
-	KeyPrefix      : "push",
-}
-
-func SelectServer(serverList []string, serverNum int) string {
-	return serverList[rand.Intn(serverNum)]
-}
-
-func GetSessionFromCID(sessionStore  *storage.SessionStore, ID string) (*storage.SessionStoreData, error) {
-	session ,err := sessionStore.Get(ID)
-	
-	if err != nil {
-		glog.Warningf("no ID : %s", ID)
-		return nil, err
-	}
-	if session != nil {
-		glog.Info(session)
-	}
-	
-	return session, nil
-}
-
-func DelSessionFromCID(sessionStore *storage.SessionStore, ID string) error {
-	err := sessionStore.Delete(ID)
-	
-	if err != nil {
-		glog.Warningf("no ID : %s", ID)
-		return err
-	}
-
-	return nil
-}
-
-func GetTopicFromTopicName(topicStore *storage.TopicStore, topicName string) (*storage.TopicStoreData, error) {
-	topic ,err := topicStore.Get(topicName)
-	
-	if err != nil {
-		glog.Warningf("no topicName : %s", topicName)
-		return nil, err
-	}
-	if topic != nil {
-		glog.Info(topic)
-	}
-	
-	return topic, nil
-}
-
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"time"
+	"math/rand"
+	"github.com/golang/glog"
+	"github.com/oikomi/gopush/storage"
+)
+
+const KeyPrefix string = "push"
+
+var DefaultRedisConnectTimeout uint32 = 2000
+var DefaultRedisReadTimeout    uint32 = 1000
+var DefaultRedisWriteTimeout   uint32 = 1000
+
+var DefaultRedisOptions storage.RedisStoreOptions = storage.RedisStoreOptions {
+	Network        : "tcp",
+	Address        : ":6379",
+	ConnectTimeout : time.Duration(DefaultRedisConnectTimeout)*time.Millisecond,
+	ReadTimeout    : time.Duration(DefaultRedisReadTimeout)*time.Millisecond,
+	WriteTimeout   : time.Duration(DefaultRedisWriteTimeout)*time.Millisecond,
+	Database       : 1,
+	KeyPrefix      : "push",
+}
+
+func SelectServer(serverList []string, serverNum int) string {
+	return serverList[rand.Intn(serverNum)]
+}
+
+func GetSessionFromCID(sessionStore storage.SessionStore, ID string) (*storage.SessionStoreData, error) {
+	session ,err := sessionStore.Get(ID)
+	
+	if err != nil {
+		glog.Warningf("no ID : %s", ID)
+		return nil, err
+	}
+	if session != nil {
+		glog.Info(session)
+	}
+	
+	return session, nil
+}
+
+func DelSessionFromCID(sessionStore storage.SessionStore, ID string) error {
+	err := sessionStore.Delete(ID)
+	
+	if err != nil {
+		glog.Warningf("no ID : %s", ID)
+		return err
+	}
+
+	return nil
+}
+
+func GetTopicFromTopicName(topicStore storage.TopicStore, topicName string) (*storage.TopicStoreData, error) {
+	topic ,err := topicStore.Get(topicName)
+	
+	if err != nil {
+		glog.Warningf("no topicName : %s", topicName)
+		return nil, err
+	}
+	if topic != nil {
+		glog.Info(topic)
+	}
+	
+	return topic, nil
+}
+
+// Members of a topic asked for per ScanMembers.
+const TopicMemberPage int = 100
+
+// Get all the members of the topic from the store, a page at a time.
+func GetTopicMembers(topicStore storage.TopicStore, topicName string) ([]*storage.Member, error) {
+	members := make([]*storage.Member, 0)
+	var cursor uint64
+	for {
+		page, next, err := topicStore.ScanMembers(topicName, cursor, TopicMemberPage)
+		if err != nil {
+			glog.Warningf("no members of topicName : %s", topicName)
+			return nil, err
+		}
+		members = append(members, page...)
+		if next == 0 {
+			return members, nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,219 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package common
+
+import (
+	"net"
+	"sync"
+	"time"
+	"errors"
+	"net/http"
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	ErrWsListenerClosed = errors.New("websocket listener closed")
+	ErrWsMsgTooLarge    = errors.New("websocket message too large")
+)
+
+const WsPath = "/ws"
+
+// WsConn makes a websocket look like a link.PacketN(2) stream: every websocket
+// message is one packet, so browsers send and receive plain JSON commands.
+type WsConn struct {
+	ws         *websocket.Conn
+	readBuf    []byte
+	writeBuf   []byte
+	writeMutex sync.Mutex
+}
+
+func NewWsConn(ws *websocket.Conn) *WsConn {
+	return &WsConn {
+		ws : ws,
+	}
+}
+
+func (self *WsConn)Read(b []byte) (int, error) {
+	if len(self.readBuf) == 0 {
+		_, msg, err := self.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) > 0xFFFF {
+			return 0, ErrWsMsgTooLarge
+		}
+		self.readBuf = make([]byte, 2, 2 + len(msg))
+		binary.BigEndian.PutUint16(self.readBuf, uint16(len(msg)))
+		self.readBuf = append(self.readBuf, msg...)
+	}
+	n := copy(b, self.readBuf)
+	self.readBuf = self.readBuf[n:]
+	
+	return n, nil
+}
+
+func (self *WsConn)Write(b []byte) (int, error) {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	self.writeBuf = append(self.writeBuf, b...)
+	for len(self.writeBuf) >= 2 {
+		size := int(binary.BigEndian.Uint16(self.writeBuf))
+		if len(self.writeBuf) < 2 + size {
+			break
+		}
+		err := self.ws.WriteMessage(websocket.TextMessage, self.writeBuf[2:2 + size])
+		if err != nil {
+			return 0, err
+		}
+		self.writeBuf = self.writeBuf[2 + size:]
+	}
+	
+	return len(b), nil
+}
+
+func (self *WsConn)Close() error {
+	return self.ws.Close()
+}
+
+func (self *WsConn)LocalAddr() net.Addr {
+	return self.ws.LocalAddr()
+}
+
+func (self *WsConn)RemoteAddr() net.Addr {
+	return self.ws.RemoteAddr()
+}
+
+func (self *WsConn)SetDeadline(t time.Time) error {
+	err := self.ws.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return self.ws.SetWriteDeadline(t)
+}
+
+func (self *WsConn)SetReadDeadline(t time.Time) error {
+	return self.ws.SetReadDeadline(t)
+}
+
+func (self *WsConn)SetWriteDeadline(t time.Time) error {
+	return self.ws.SetWriteDeadline(t)
+}
+
+// WsListener is a net.Listener of websocket connections, so link.NewServer
+// can serve web clients with the same protocol handlers as TCP clients.
+type WsListener struct {
+	listener  net.Listener
+	upgrader  websocket.Upgrader
+	conns     chan net.Conn
+	closed    chan bool
+	closeOnce sync.Once
+}
+
+// Build the origin check of the websocket upgrade. A request without an
+// Origin comes from a non-browser client and passes. With no origins only
+// the pages of the same host pass, and "*" lets every origin pass.
+func newOriginChecker(origins []string) func(r *http.Request) bool {
+	if len(origins) == 0 {
+		return nil
+	}
+	allowed := make(map[string]bool)
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || allowed["*"] || allowed[origin]
+	}
+}
+
+// Listen for websockets on address. Browsers may only connect from the
+// origins, see newOriginChecker.
+func NewWsListener(address string, cfg *TLSConfig, origins []string) (*WsListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil && cfg.Enable {
+		tlsConfig, err := NewServerTLSConfig(cfg)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	
+	self := &WsListener {
+		listener : listener,
+		upgrader : websocket.Upgrader {
+			ReadBufferSize  : 4096,
+			WriteBufferSize : 4096,
+			CheckOrigin     : newOriginChecker(origins),
+		},
+		conns    : make(chan net.Conn),
+		closed   : make(chan bool),
+	}
+	
+	mux := http.NewServeMux()
+	mux.HandleFunc(WsPath, self.handleWs)
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+		self.Close()
+	}()
+	
+	return self, nil
+}
+
+func (self *WsListener)handleWs(w http.ResponseWriter, r *http.Request) {
+	ws, err := self.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		glog.Error(err.Error())
+		return
+	}
+	
+	select {
+	case self.conns <- NewWsConn(ws):
+	case <-self.closed:
+		ws.Close()
+	}
+}
+
+func (self *WsListener)Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.closed:
+		return nil, ErrWsListenerClosed
+	}
+}
+
+func (self *WsListener)Close() error {
+	var err error
+	self.closeOnce.Do(func() {
+		close(self.closed)
+		err = self.listener.Close()
+	})
+	return err
+}
+
+func (self *WsListener)Addr() net.Addr {
+	return self.listener.Addr()
+}
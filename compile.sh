@@ -19,3 +19,11 @@ cd ..
 cd manager
 go build
 cd ..
+
+cd bench
+go build -o gopush-bench
+cd ..
+
+cd migrate
+go build -o gopush-migrate
+cd ..
@@ -18,9 +18,12 @@ package main
 import (
 	"fmt"
 	"flag"
+	"time"
+	"encoding/json"
 	"github.com/golang/glog"
 	"github.com/funny/link"
 	"github.com/oikomi/gopush/common"
+	"github.com/oikomi/gopush/protocol"
 )
 
 /*
@@ -55,6 +58,75 @@ func init() {
 
 var InputConfFile = flag.String("conf_file", "gateway.json", "input conf file name")   
 
+// The client sends its ID first, so the msg_server can be picked by client
+// ID, and its token if it has one. Only the consistent_hash strategy and
+// IssueToken need the ID.
+func readClientID(cfg *GatewayConfig, session *link.Session) (string, string, error) {
+	session.Conn().SetReadDeadline(time.Now().Add(cfg.ClientIDTimeout * time.Second))
+	inMsg, err := session.Read()
+	if err != nil {
+		return "", "", err
+	}
+	session.Conn().SetReadDeadline(time.Time{})
+	
+	var c protocol.CmdSimple
+	err = json.Unmarshal(inMsg.Get(), &c)
+	if err != nil {
+		return "", "", err
+	}
+	if c.CmdName != protocol.SEND_CLIENT_ID_CMD || len(c.Args) < 1 {
+		return "", "", BADCLIENTID
+	}
+	token := ""
+	if len(c.Args) > 1 {
+		token = c.Args[1]
+	}
+	
+	return c.Args[0], token, nil
+}
+
+// Tell the client which msg_server to connect to. A client that shows a
+// valid token gets a fresh one, the gateway never issues a token to a
+// client that has none.
+func handleClient(cfg *GatewayConfig, gw *Gateway, session *link.Session, ws bool) {
+	var clientID, token string
+	var err error
+	if cfg.SelectStrategy == common.SELECT_CONSISTENT_HASH || cfg.IssueToken {
+		clientID, token, err = readClientID(cfg, session)
+	}
+	if err != nil {
+		if cfg.SelectStrategy == common.SELECT_CONSISTENT_HASH {
+			glog.Error(err.Error())
+			session.Close(nil)
+			return
+		}
+		glog.Warningf("client %s sent no ID : %s", session.Conn().RemoteAddr().String(), err.Error())
+	}
+	
+	msgServer, err := gw.selectMsgServer(clientID, ws)
+	if err != nil {
+		glog.Error(err.Error())
+		session.Close(nil)
+		return
+	}
+	
+	err = session.Send(link.Binary(msgServer))
+	if err != nil {
+		glog.Error(err.Error())
+		return
+	}
+	if cfg.IssueToken && token != "" && common.VerifyToken(cfg.AuthSecret, clientID, token) == nil {
+		token = common.NewToken(cfg.AuthSecret, clientID, cfg.TokenExpire * time.Second)
+		err = session.Send(link.Binary(token))
+		if err != nil {
+			glog.Error(err.Error())
+			return
+		}
+	}
+	session.Close(nil)
+	glog.Info("client ", session.Conn().RemoteAddr().String(), " | close")
+}
+
 func main() {
 	version()
 	fmt.Printf("built on %s\n", BuildTime())
@@ -68,23 +140,34 @@ func main() {
 	
 	p := link.PacketN(2, link.BigEndianBO, link.LittleEndianBF)
 	
-	server, err := link.Listen(cfg.TransportProtocols, cfg.Listen, p)
+	server, err := common.Listen(cfg.TransportProtocols, cfg.Listen, &cfg.TLS, p)
 	if err != nil {
 		glog.Error(err.Error())
 		return
 	}
 	glog.Info("server start: ", server.Listener().Addr().String())
+	
+	gw := NewGateway(cfg)
+	go gw.watchMsgServers()
+	go gw.probeMsgServers()
 
-	server.AcceptLoop(func(session *link.Session) {
-		glog.Info("client ", session.Conn().RemoteAddr().String(), " | in")
-		msgServer := common.SelectServer(cfg.MsgServerList, cfg.MsgServerNum)
-		
-		err = session.Send(link.Binary(msgServer))
+	if cfg.WsListen != "" {
+		wsListener, err := common.NewWsListener(cfg.WsListen, &cfg.TLS, cfg.WsOrigins)
 		if err != nil {
 			glog.Error(err.Error())
 			return
 		}
-		session.Close(nil)
-		glog.Info("client ", session.Conn().RemoteAddr().String(), " | close")
+		wsServer := link.NewServer(wsListener, p)
+		glog.Info("websocket server start: ", wsListener.Addr().String())
+		
+		go wsServer.AcceptLoop(func(session *link.Session) {
+			glog.Info("web client ", session.Conn().RemoteAddr().String(), " | in")
+			go handleClient(cfg, gw, session, true)
+		})
+	}
+
+	server.AcceptLoop(func(session *link.Session) {
+		glog.Info("client ", session.Conn().RemoteAddr().String(), " | in")
+		go handleClient(cfg, gw, session, false)
 	})
 }
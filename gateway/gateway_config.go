@@ -18,21 +18,48 @@ package main
 import (
 	"os"
 	"encoding/json"
+	"time"
 	"github.com/golang/glog"
+	"github.com/oikomi/gopush/common"
 )
 
 type GatewayConfig struct {
 	configfile         string
 	TransportProtocols string
 	Listen             string
+	WsListen           string
+	WsOrigins          []string
+	TLS                common.TLSConfig
 	LogFile            string
-	MsgServerList      []string
-	MsgServerNum       int
+	WatchInterval      time.Duration
+	SelectStrategy     string
+	ProbeInterval      time.Duration
+	ProbeTimeout       time.Duration
+	ClientIDTimeout    time.Duration
+	IssueToken         bool
+	AuthSecret         string
+	TokenExpire        time.Duration
+	Redis struct { 
+		Addr string 
+		Port string
+		ConnectTimeout time.Duration
+		ReadTimeout time.Duration
+		WriteTimeout time.Duration
+		MaxIdle int
+		MaxActive int
+		IdleTimeout time.Duration
+	} 
 }
 
 func NewGatewayConfig(configfile string) *GatewayConfig {
 	return &GatewayConfig {
-		configfile : configfile,
+		configfile      : configfile,
+		WatchInterval   : 5,
+		SelectStrategy  : "random",
+		ProbeInterval   : 5,
+		ProbeTimeout    : 1000,
+		ClientIDTimeout : 5,
+		TokenExpire     : 86400,
 	}
 }
 
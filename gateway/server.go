@@ -0,0 +1,160 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"net/http"
+	"time"
+	"github.com/golang/glog"
+	"github.com/oikomi/gopush/common"
+	"github.com/oikomi/gopush/storage"
+)
+
+type Gateway struct {
+	cfg              *GatewayConfig
+	msgServerStore   *storage.MsgServerStore
+	msgServerList    []*storage.MsgServerStoreData
+	healthMap        map[string]bool
+	selector         common.ServerSelector
+	listMutex        sync.RWMutex
+}
+
+func NewGateway(cfg *GatewayConfig) *Gateway {
+	rs := storage.NewRedisStore(&storage.RedisStoreOptions {
+		Network        : "tcp",
+		Address        : cfg.Redis.Port,
+		ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
+		ReadTimeout    : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
+		WriteTimeout   : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
+		Database       : 1,
+		KeyPrefix      : "push",
+		MaxIdle        : cfg.Redis.MaxIdle,
+		MaxActive      : cfg.Redis.MaxActive,
+		IdleTimeout    : cfg.Redis.IdleTimeout*time.Second,
+	})
+	return &Gateway {
+		cfg                : cfg,
+		msgServerStore     : storage.NewMsgServerStore(rs),
+		msgServerList      : make([]*storage.MsgServerStoreData, 0),
+		healthMap          : make(map[string]bool),
+		selector           : common.NewServerSelector(cfg.SelectStrategy),
+	}
+}
+
+func (self *Gateway)updateMsgServers() error {
+	list, err := self.msgServerStore.List()
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	self.listMutex.Lock()
+	defer self.listMutex.Unlock()
+	self.msgServerList = list
+	
+	return nil
+}
+
+// Watch the msg_server registry so new msg_servers are handed out to
+// clients without a restart.
+func (self *Gateway)watchMsgServers() {
+	glog.Info("watchMsgServers")
+	timer := time.NewTicker(self.cfg.WatchInterval * time.Second)
+	for {
+		self.updateMsgServers()
+		<-timer.C
+	}
+}
+
+// Probe the health endpoint of the msg_server. A msg_server without one is
+// only watched through the registry.
+func (self *Gateway)probeMsgServer(client *http.Client, ms *storage.MsgServerStoreData) bool {
+	if ms.HealthAddr == "" {
+		return true
+	}
+	resp, err := client.Get(ms.HealthAddr)
+	if err != nil {
+		glog.Warningf("probe msg_server %s failed : %s", ms.MsgServerAddr, err.Error())
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		glog.Warningf("probe msg_server %s failed : %s", ms.MsgServerAddr, resp.Status)
+		return false
+	}
+	
+	return true
+}
+
+// Probe every registered msg_server, the ones that fail are not handed out
+// until they pass a probe again.
+func (self *Gateway)probeMsgServers() {
+	glog.Info("probeMsgServers")
+	client := &http.Client {
+		Timeout : self.cfg.ProbeTimeout * time.Millisecond,
+	}
+	timer := time.NewTicker(self.cfg.ProbeInterval * time.Second)
+	for {
+		<-timer.C
+		self.listMutex.RLock()
+		list := self.msgServerList
+		self.listMutex.RUnlock()
+		
+		healthMap := make(map[string]bool)
+		for _, ms := range list {
+			healthMap[ms.MsgServerAddr] = self.probeMsgServer(client, ms)
+		}
+		
+		self.listMutex.Lock()
+		self.healthMap = healthMap
+		self.listMutex.Unlock()
+	}
+}
+
+// Pick a msg_server for clientID. Web clients get the websocket address of
+// a msg_server that serves websocket.
+func (self *Gateway)selectMsgServer(clientID string, ws bool) (string, error) {
+	self.listMutex.Lock()
+	defer self.listMutex.Unlock()
+	list := make([]*storage.MsgServerStoreData, 0)
+	for _, ms := range self.msgServerList {
+		healthy, probed := self.healthMap[ms.MsgServerAddr]
+		if probed && !healthy {
+			continue
+		}
+		if ws && ms.WsAddr == "" {
+			continue
+		}
+		list = append(list, ms)
+	}
+	if len(list) == 0 {
+		return "", NOMSGSERVER
+	}
+	
+	addr := self.selector.Select(list, clientID)
+	for _, ms := range list {
+		if ms.MsgServerAddr == addr {
+			// count the client until the msg_server reports its load again
+			ms.SessionNum = ms.SessionNum + 1
+			if ws {
+				return ms.WsAddr, nil
+			}
+		}
+	}
+	
+	return addr, nil
+}
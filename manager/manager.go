@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/funny/link"
+	"github.com/oikomi/gopush/common"
 )
 
 /*
@@ -67,14 +68,14 @@ func main() {
 	
 	p := link.PacketN(2, link.BigEndianBO, link.LittleEndianBF)
 	
-	server, err := link.Listen(cfg.TransportProtocols, cfg.Listen, p)
+	server, err := common.Listen(cfg.TransportProtocols, cfg.Listen, &cfg.TLS, p)
 	if err != nil {
 		glog.Error(err.Error())
 	}
 	glog.Info("server start:", server.Listener().Addr().String())
 	
 	sm := NewManager(cfg)
-	go sm.subscribeChannels()
+	go sm.watchMsgServers()
 	
 	server.AcceptLoop(func(session *link.Session) {
 	
@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"time"
 	"github.com/golang/glog"
+	"github.com/oikomi/gopush/common"
 )
 
 type ManagerConfig struct {
@@ -28,19 +29,30 @@ type ManagerConfig struct {
 	Listen             string
 	LogFile            string
 	UUID               string
-	MsgServerList      []string
+	WatchInterval        time.Duration
+	ReconnectInterval    time.Duration
+	MaxReconnectInterval time.Duration
+	TLS                  common.TLSConfig
+	MsgServerTLS         common.TLSConfig
+	PeerSecret           string
 	Redis struct { 
 		Addr string 
 		Port string
 		ConnectTimeout time.Duration
 		ReadTimeout time.Duration
 		WriteTimeout time.Duration
+		MaxIdle int
+		MaxActive int
+		IdleTimeout time.Duration
 	} 
 }
 
 func NewManagerConfig(configfile string) *ManagerConfig {
 	return &ManagerConfig{
-		configfile : configfile,
+		configfile           : configfile,
+		WatchInterval        : 5,
+		ReconnectInterval    : 1,
+		MaxReconnectInterval : 60,
 	}
 }
 
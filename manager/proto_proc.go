@@ -1,65 +1,245 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package main
-
-import (
-	"flag"
-	"github.com/golang/glog"
-	"github.com/funny/link"
-	"github.com/oikomi/gopush/protocol"
-	"github.com/oikomi/gopush/storage"
-)
-
-func init() {
-	flag.Set("alsologtostderr", "true")
-	flag.Set("log_dir", "false")
-}
-
-type ProtoProc struct {
-	Manager   *Manager
-}
-
-func NewProtoProc(m *Manager) *ProtoProc {
-	return &ProtoProc {
-		Manager : m,
-	}
-}
-
-func (self *ProtoProc)procStoreSession(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procStoreSession")
-	var err error
-	glog.Info(cmd.GetAnyData())
-	err = self.Manager.sessionStore.Set(cmd.GetAnyData().(*storage.SessionStoreData))
-	if err != nil {
-		glog.Error("error:", err)
-	}
-	glog.Info("set sesion id success")
-	
-	return nil
-}
-
-func (self *ProtoProc)procStoreTopic(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procStoreTopic")
-	var err error
-	glog.Info(cmd.GetAnyData())
-	err = self.Manager.topicStore.Set(cmd.GetAnyData().(*storage.TopicStoreData))
-	if err != nil {
-		glog.Error("error:", err)
-	}
-	glog.Info("set sesion id success")
-	
-	return nil
-}
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"github.com/golang/glog"
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/protocol"
+	"github.com/oikomi/gopush/storage"
+)
+
+func init() {
+	flag.Set("alsologtostderr", "true")
+	flag.Set("log_dir", "false")
+}
+
+type ProtoProc struct {
+	Manager   *Manager
+}
+
+func NewProtoProc(m *Manager) *ProtoProc {
+	return &ProtoProc {
+		Manager : m,
+	}
+}
+
+func (self *ProtoProc)procStoreSession(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procStoreSession")
+	var err error
+	glog.Info(cmd.GetAnyData())
+	sess := cmd.GetAnyData().(*storage.SessionStoreData)
+	self.Manager.sessionMutex.Lock()
+	defer self.Manager.sessionMutex.Unlock()
+	err = self.Manager.sessionStore.Set(sess)
+	if err != nil {
+		glog.Error("error:", err)
+	}
+	err = self.Manager.sessionStore.AddHostSession(sess.MsgServerAddr, sess.ClientID)
+	if err != nil {
+		glog.Error("error:", err)
+	}
+	glog.Info("set sesion id success")
+	
+	return nil
+}
+
+// Add a device to the session of a client that may log in on several devices.
+func (self *ProtoProc)procStoreDevice(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procStoreDevice")
+	var err error
+	sess := cmd.GetAnyData().(*storage.SessionStoreData)
+	self.Manager.sessionMutex.Lock()
+	defer self.Manager.sessionMutex.Unlock()
+	err = self.Manager.sessionStore.AddHostSession(sess.MsgServerAddr, sess.ClientID)
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	old, err := self.Manager.sessionStore.Get(sess.ClientID)
+	if err == nil {
+		old.MergeDevices(sess)
+		sess = old
+	}
+	err = self.Manager.sessionStore.Set(sess)
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	return nil
+}
+
+// Remove a closed device. The session is deleted with its last device, and
+// leaves the session index of the msg_server with its last device there.
+func (self *ProtoProc)procDeleteDevice(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procDeleteDevice")
+	var err error
+	dev := cmd.GetAnyData().(*storage.SessionStoreData)
+	self.Manager.sessionMutex.Lock()
+	defer self.Manager.sessionMutex.Unlock()
+	sess, err := self.Manager.sessionStore.Get(dev.ClientID)
+	if err != nil {
+		return self.Manager.sessionStore.RemoveHostSession(dev.MsgServerAddr, dev.ClientID)
+	}
+	sess.RemoveDevice(dev.ID, dev.MsgServerAddr)
+	if !hasDeviceOn(sess, dev.MsgServerAddr) {
+		err = self.Manager.sessionStore.RemoveHostSession(dev.MsgServerAddr, dev.ClientID)
+		if err != nil {
+			glog.Error("error:", err)
+			return err
+		}
+	}
+	if len(sess.DeviceList) > 0 {
+		err = self.Manager.sessionStore.Set(sess)
+	} else if sess.ID == dev.ID && sess.MsgServerAddr == dev.MsgServerAddr {
+		err = self.Manager.sessionStore.Delete(dev.ClientID)
+	}
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	return nil
+}
+
+// Check whether the session has a device on the msg_server msgServerAddr.
+func hasDeviceOn(sess *storage.SessionStoreData, msgServerAddr string) bool {
+	for _, d := range sess.DeviceList {
+		if d.MsgServerAddr == msgServerAddr {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *ProtoProc)procStoreTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procStoreTopic")
+	var err error
+	glog.Info(cmd.GetAnyData())
+	tsd := cmd.GetAnyData().(*storage.TopicStoreData)
+	self.Manager.topicMutex.Lock()
+	defer self.Manager.topicMutex.Unlock()
+	err = self.checkTopicHolder(tsd, session)
+	if err != nil {
+		return err
+	}
+	err = self.Manager.topicStore.Set(tsd)
+	if err != nil {
+		glog.Error("error:", err)
+	}
+	
+	// the topic moves between msg_servers only by MoveTopic
+	err = self.Manager.topicStore.AddHostTopic(tsd.MsgServerAddr, tsd.TopicName)
+	if err != nil {
+		glog.Error("error:", err)
+	}
+	
+	glog.Info("set sesion id success")
+	
+	return nil
+}
+
+// Add a member to a topic, or update it, along with the topic list of the member.
+func (self *ProtoProc)procStoreTopicMember(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procStoreTopicMember")
+	var err error
+	topicName := cmd.GetArgs()[0]
+	m := cmd.GetAnyData().(*storage.Member)
+	err = self.Manager.topicStore.AddMember(topicName, m)
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	err = self.Manager.topicStore.AddClientTopic(m.ID, topicName)
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	return nil
+}
+
+// Remove a member from a topic, along with the topic list of the member.
+func (self *ProtoProc)procDeleteTopicMember(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procDeleteTopicMember")
+	var err error
+	topicName := cmd.GetArgs()[0]
+	m := cmd.GetAnyData().(*storage.Member)
+	err = self.Manager.topicStore.RemoveMember(topicName, m.ID)
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	err = self.Manager.topicStore.RemoveClientTopic(m.ID, topicName)
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	return nil
+}
+
+// Check that the msg_server of tsd is the one holding the topic in the
+// store, if the topic is there. A msg_server which lost the topic in a
+// failover is told to drop it. The caller holds topicMutex.
+func (self *ProtoProc)checkTopicHolder(tsd *storage.TopicStoreData, session *link.Session) error {
+	old, err := self.Manager.topicStore.Get(tsd.TopicName)
+	if err == storage.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	if old.MsgServerAddr == tsd.MsgServerAddr {
+		return nil
+	}
+	glog.Warningf("topic %s is held by %s, not %s", tsd.TopicName, old.MsgServerAddr, tsd.MsgServerAddr)
+	self.Manager.dropTopics(session, tsd.TopicName)
+	return NOTHOLDER
+}
+
+func (self *ProtoProc)procDeleteTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procDeleteTopic")
+	var err error
+	tsd := cmd.GetAnyData().(*storage.TopicStoreData)
+	self.Manager.topicMutex.Lock()
+	defer self.Manager.topicMutex.Unlock()
+	err = self.checkTopicHolder(tsd, session)
+	if err != nil {
+		return err
+	}
+	for _, m := range tsd.MemberList {
+		err = self.Manager.topicStore.RemoveClientTopic(m.ID, tsd.TopicName)
+		if err != nil {
+			glog.Error("error:", err)
+		}
+	}
+	err = self.Manager.topicStore.RemoveHostTopic(tsd.MsgServerAddr, tsd.TopicName)
+	if err != nil {
+		glog.Error("error:", err)
+	}
+	err = self.Manager.topicStore.Delete(tsd.TopicName)
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	glog.Info("delete topic success")
+	
+	return nil
+}
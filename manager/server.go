@@ -1,156 +1,471 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package main
-
-import (
-	"time"
-	"encoding/json"
-	"github.com/golang/glog"
-	"github.com/funny/link"
-	"github.com/oikomi/gopush/storage"
-	"github.com/oikomi/gopush/protocol"
-)
-
-type Manager struct {
-	cfg          *ManagerConfig
-	sessionStore *storage.SessionStore
-	topicStore   *storage.TopicStore
-}   
-
-func NewManager(cfg *ManagerConfig) *Manager {
-	return &Manager {
-		cfg : cfg,
-		sessionStore       : storage.NewSessionStore(storage.NewRedisStore(&storage.RedisStoreOptions {
-			Network        : "tcp",
-			Address        : cfg.Redis.Port,
-			ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
-			ReadTimeout    : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
-			WriteTimeout   : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
-			Database       : 1,
-			KeyPrefix      : "push",
-		})),
-		topicStore         : storage.NewTopicStore(storage.NewRedisStore(&storage.RedisStoreOptions {
-			Network        : "tcp",
-			Address        : cfg.Redis.Port,
-			ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
-			ReadTimeout    : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
-			WriteTimeout   : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
-			Database       : 1,
-			KeyPrefix      : "push",
-		})),
-	}
-}
-
-func (self *Manager)connectMsgServer(ms string) (*link.Session, error) {
-	p := link.PacketN(2, link.BigEndianBO, link.LittleEndianBF)
-	client, err := link.Dial("tcp", ms, p)
-	if err != nil {
-		glog.Error(err.Error())
-		panic(err)
-	}
-
-	return client, err
-}
-
-func (self *Manager)parseProtocol(cmd []byte, session *link.Session) error {
-	var c protocol.CmdInternal
-	
-	err := json.Unmarshal(cmd, &c)
-	if err != nil {
-		glog.Error("error:", err)
-		return err
-	}
-	
-	pp := NewProtoProc(self)
-	
-	glog.Info(c)
-	glog.Info(c.CmdName)
-
-	switch c.CmdName {
-		case protocol.STORE_SESSION_CMD:
-			var ssc SessionStoreCmd
-			err := json.Unmarshal(cmd, &ssc)
-			if err != nil {
-				glog.Error("error:", err)
-				return err
-			}
-			pp.procStoreSession(ssc, session)
-		case protocol.STORE_TOPIC_CMD:
-			var tsc TopicStoreCmd
-			err := json.Unmarshal(cmd, &tsc)
-			if err != nil {
-				glog.Error("error:", err)
-				return err
-			}
-			pp.procStoreTopic(tsc, session)
-		}
-
-	return err
-}
-
-func (self *Manager)handleMsgServerClient(msc *link.Session) {
-	msc.ReadLoop(func(msg link.InBuffer) {
-		glog.Info("msg_server", msc.Conn().RemoteAddr().String(),"say:", string(msg.Get()))
-		
-		self.parseProtocol(msg.Get(), msc)
-	})
-}
-
-func (self *Manager)subscribeChannels() error {
-	glog.Info("subscribeChannels")
-	var msgServerClientList []*link.Session
-	for _, ms := range self.cfg.MsgServerList {
-		msgServerClient, err := self.connectMsgServer(ms)
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-		cmd := protocol.NewCmdSimple()
-		
-		cmd.CmdName = protocol.SUBSCRIBE_CHANNEL_CMD
-		cmd.Args = append(cmd.Args, protocol.SYSCTRL_CLIENT_STATUS)
-		cmd.Args = append(cmd.Args, self.cfg.UUID)
-		
-		err = msgServerClient.Send(link.JSON {
-			cmd,
-		})
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-		
-		cmd = protocol.NewCmdSimple()
-		
-		cmd.CmdName = protocol.SUBSCRIBE_CHANNEL_CMD
-		cmd.Args = append(cmd.Args, protocol.SYSCTRL_TOPIC_STATUS)
-		cmd.Args = append(cmd.Args, self.cfg.UUID)
-		
-		err = msgServerClient.Send(link.JSON {
-			cmd,
-		})
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-		
-		msgServerClientList = append(msgServerClientList, msgServerClient)
-	}
-
-	for _, msc := range msgServerClientList {
-		go self.handleMsgServerClient(msc)
-	}
-	return nil
-}
\ No newline at end of file
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/common"
+	"github.com/oikomi/gopush/storage"
+	"github.com/oikomi/gopush/protocol"
+)
+
+type Manager struct {
+	cfg              *ManagerConfig
+	sessionStore     storage.SessionStore
+	topicStore       storage.TopicStore
+	msgServerStore   *storage.MsgServerStore
+	msgServerKeepers map[string]bool
+	keeperMutex      sync.Mutex
+	msgServerClientMap  map[string]*link.Session
+	msgServerClientMutex sync.RWMutex
+	deadMsgServers   map[string]bool
+	sessionMutex     sync.Mutex
+	topicMutex       sync.Mutex
+}   
+
+func NewManager(cfg *ManagerConfig) *Manager {
+	rs := storage.NewRedisStore(&storage.RedisStoreOptions {
+		Network        : "tcp",
+		Address        : cfg.Redis.Port,
+		ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
+		ReadTimeout    : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
+		WriteTimeout   : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
+		Database       : 1,
+		KeyPrefix      : "push",
+		MaxIdle        : cfg.Redis.MaxIdle,
+		MaxActive      : cfg.Redis.MaxActive,
+		IdleTimeout    : cfg.Redis.IdleTimeout*time.Second,
+	})
+	backend := &storage.BackendOptions {
+		Redis : rs,
+	}
+	return &Manager {
+		cfg : cfg,
+		sessionStore       : storage.NewSessionStore(backend),
+		topicStore         : storage.NewTopicStore(backend),
+		msgServerStore     : storage.NewMsgServerStore(rs),
+		msgServerKeepers   : make(map[string]bool),
+		msgServerClientMap : make(map[string]*link.Session),
+		deadMsgServers     : make(map[string]bool),
+	}
+}
+
+func (self *Manager)connectMsgServer(ms string) (*link.Session, error) {
+	p := link.PacketN(2, link.BigEndianBO, link.LittleEndianBF)
+	client, err := common.Dial("tcp", ms, &self.cfg.MsgServerTLS, p)
+	if err != nil {
+		glog.Error(err.Error())
+		return nil, err
+	}
+
+	return client, err
+}
+
+func (self *Manager)getMsgServerClient(ms string) (*link.Session, error) {
+	self.msgServerClientMutex.RLock()
+	defer self.msgServerClientMutex.RUnlock()
+	msc := self.msgServerClientMap[ms]
+	if msc == nil {
+		return nil, NOMSGSERVER
+	}
+	
+	return msc, nil
+}
+
+func (self *Manager)setMsgServerClient(ms string, msc *link.Session) {
+	self.msgServerClientMutex.Lock()
+	defer self.msgServerClientMutex.Unlock()
+	if msc == nil {
+		delete(self.msgServerClientMap, ms)
+	} else {
+		self.msgServerClientMap[ms] = msc
+	}
+}
+
+func (self *Manager)parseProtocol(cmd []byte, session *link.Session) error {
+	var c protocol.CmdInternal
+	
+	err := json.Unmarshal(cmd, &c)
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	pp := NewProtoProc(self)
+	
+	glog.Info(c)
+	glog.Info(c.CmdName)
+
+	switch c.CmdName {
+		case protocol.STORE_SESSION_CMD:
+			var ssc SessionStoreCmd
+			err := json.Unmarshal(cmd, &ssc)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+			pp.procStoreSession(ssc, session)
+		case protocol.STORE_DEVICE_CMD, protocol.DELETE_DEVICE_CMD:
+			var ssc SessionStoreCmd
+			err := json.Unmarshal(cmd, &ssc)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+			if c.CmdName == protocol.STORE_DEVICE_CMD {
+				pp.procStoreDevice(ssc, session)
+			} else {
+				pp.procDeleteDevice(ssc, session)
+			}
+		case protocol.STORE_TOPIC_CMD:
+			var tsc TopicStoreCmd
+			err := json.Unmarshal(cmd, &tsc)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+			pp.procStoreTopic(tsc, session)
+		case protocol.STORE_TOPIC_MEMBER_CMD, protocol.DELETE_TOPIC_MEMBER_CMD:
+			var tmc TopicMemberCmd
+			err := json.Unmarshal(cmd, &tmc)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+			if c.CmdName == protocol.STORE_TOPIC_MEMBER_CMD {
+				pp.procStoreTopicMember(tmc, session)
+			} else {
+				pp.procDeleteTopicMember(tmc, session)
+			}
+		case protocol.DELETE_TOPIC_CMD:
+			var tsc TopicStoreCmd
+			err := json.Unmarshal(cmd, &tsc)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+			pp.procDeleteTopic(tsc, session)
+		}
+
+	return err
+}
+
+func (self *Manager)handleMsgServerClient(msc *link.Session) {
+	msc.ReadLoop(func(msg link.InBuffer) {
+		glog.Info("msg_server", msc.Conn().RemoteAddr().String(),"say:", string(msg.Get()))
+		
+		self.parseProtocol(msg.Get(), msc)
+	})
+}
+
+func (self *Manager)subscribeChannel(msc *link.Session, channelName string, token string) error {
+	cmd := protocol.NewCmdSimple()
+	
+	cmd.CmdName = protocol.SUBSCRIBE_CHANNEL_CMD
+	cmd.Args = append(cmd.Args, channelName)
+	cmd.Args = append(cmd.Args, self.cfg.UUID)
+	if token != "" {
+		cmd.Args = append(cmd.Args, token)
+	}
+	
+	err := msc.Send(link.JSON {
+		cmd,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return nil
+}
+
+// Keep a link to the msg_server ms on its peer address addr. The link is
+// redialed with exponential backoff whenever it can not be made or is lost,
+// and the channels are subscribed again on every new link.
+func (self *Manager)keepMsgServerClient(ms string, addr string) {
+	glog.Info("keepMsgServerClient ", ms, " ", addr)
+	retry := self.cfg.ReconnectInterval * time.Second
+	for {
+		token := ""
+		msgServerClient, err := self.connectMsgServer(addr)
+		if err == nil && self.cfg.PeerSecret != "" {
+			token, err = common.PeerToken(msgServerClient, self.cfg.PeerSecret, self.cfg.UUID)
+		}
+		if err == nil {
+			err = self.subscribeChannel(msgServerClient, protocol.SYSCTRL_CLIENT_STATUS, token)
+		}
+		if err == nil {
+			err = self.subscribeChannel(msgServerClient, protocol.SYSCTRL_TOPIC_STATUS, token)
+		}
+		if err == nil {
+			// its topics may have been failed over while it was away
+			err = self.dropTopics(msgServerClient)
+		}
+		if err == nil {
+			retry = self.cfg.ReconnectInterval * time.Second
+			self.setMsgServerClient(ms, msgServerClient)
+			self.handleMsgServerClient(msgServerClient)
+			self.setMsgServerClient(ms, nil)
+			glog.Warningf("lost msg_server : %s", ms)
+		} else if msgServerClient != nil {
+			msgServerClient.Close(nil)
+		}
+		
+		if !self.keepingMsgServer(ms) {
+			glog.Infof("msg_server %s unregistered", ms)
+			return
+		}
+		glog.Infof("reconnect msg_server %s in %s", ms, retry)
+		time.Sleep(retry)
+		retry = retry * 2
+		if retry > self.cfg.MaxReconnectInterval * time.Second {
+			retry = self.cfg.MaxReconnectInterval * time.Second
+		}
+	}
+}
+
+// Tell the msg_server on msc to drop the topics topicNames, or all its
+// topics with none, if another msg_server holds them now.
+func (self *Manager)dropTopics(msc *link.Session, topicNames ...string) error {
+	cmd := protocol.NewCmdSimple()
+	cmd.CmdName = protocol.DROP_TOPIC_CMD
+	cmd.Args = append(cmd.Args, topicNames...)
+	
+	err := msc.Send(link.JSON {
+		cmd,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return nil
+}
+
+// Stop the keeper of ms if ms has left the registry.
+func (self *Manager)keepingMsgServer(ms string) bool {
+	self.keeperMutex.Lock()
+	defer self.keeperMutex.Unlock()
+	if !self.msgServerKeepers[ms] {
+		delete(self.msgServerKeepers, ms)
+		return false
+	}
+	
+	return true
+}
+
+// Find the msg_servers which hold topics but are not in the registry. They
+// died unseen, e.g. while the manager was down.
+func (self *Manager)findOrphanHosts(list []*storage.MsgServerStoreData) ([]string, error) {
+	live := make(map[string]bool)
+	for _, ms := range list {
+		live[ms.MsgServerAddr] = true
+	}
+	hosts, err := self.topicStore.GetHosts()
+	if err != nil {
+		return nil, err
+	}
+	orphans := make([]string, 0)
+	for _, ms := range hosts {
+		if !live[ms] {
+			orphans = append(orphans, ms)
+		}
+	}
+	return orphans, nil
+}
+
+func (self *Manager)updateMsgServers() error {
+	list, err := self.msgServerStore.List()
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	orphans, err := self.findOrphanHosts(list)
+	if err != nil {
+		glog.Error(err.Error())
+	}
+	
+	self.keeperMutex.Lock()
+	for ms := range self.msgServerKeepers {
+		self.msgServerKeepers[ms] = false
+	}
+	for _, ms := range list {
+		_, ok := self.msgServerKeepers[ms.MsgServerAddr]
+		self.msgServerKeepers[ms.MsgServerAddr] = true
+		delete(self.deadMsgServers, ms.MsgServerAddr)
+		if !ok {
+			glog.Info("new msg_server ", ms.MsgServerAddr)
+			go self.keepMsgServerClient(ms.MsgServerAddr, ms.PeerAddr())
+		}
+	}
+	for ms, alive := range self.msgServerKeepers {
+		if !alive {
+			glog.Warningf("msg_server %s is dead", ms)
+			self.deadMsgServers[ms] = true
+		}
+	}
+	for _, ms := range orphans {
+		if !self.deadMsgServers[ms] {
+			glog.Warningf("msg_server %s is gone with its topics", ms)
+			self.deadMsgServers[ms] = true
+		}
+	}
+	dead := make([]string, 0)
+	for ms := range self.deadMsgServers {
+		dead = append(dead, ms)
+	}
+	self.keeperMutex.Unlock()
+	
+	for _, ms := range dead {
+		self.failoverMsgServer(ms, list)
+	}
+	
+	return nil
+}
+
+// Hand the topics of the dead msg_server ms over to the live msg_servers,
+// the one with the fewest topics first. A topic is moved in the topic store
+// before the new msg_server is told to take it over, and only if ms still
+// holds it, so a topic never has two holders in the store. The dead
+// msg_server is forgotten once none of its topics is left, and its sessions
+// with it.
+func (self *Manager)failoverMsgServer(ms string, list []*storage.MsgServerStoreData) {
+	topicNames, err := self.topicStore.GetHostTopics(ms)
+	if err != nil {
+		glog.Error(err.Error())
+		return
+	}
+	if len(topicNames) == 0 {
+		err = self.purgeMsgServerSessions(ms)
+		if err != nil {
+			glog.Error(err.Error())
+			return
+		}
+		self.keeperMutex.Lock()
+		delete(self.deadMsgServers, ms)
+		self.keeperMutex.Unlock()
+		return
+	}
+	
+	for _, topicName := range topicNames {
+		var target *storage.MsgServerStoreData
+		for _, live := range list {
+			if target == nil || live.TopicNum < target.TopicNum {
+				target = live
+			}
+		}
+		if target == nil {
+			glog.Warningf("no msg_server to take over topic %s", topicName)
+			return
+		}
+		
+		msc, err := self.getMsgServerClient(target.MsgServerAddr)
+		if err != nil {
+			glog.Warningf("no msg_server : %s", target.MsgServerAddr)
+			return
+		}
+		moved, err := self.moveTopic(topicName, ms, target.MsgServerAddr)
+		if err != nil {
+			glog.Error(err.Error())
+			return
+		}
+		if !moved {
+			glog.Infof("topic %s is no longer held by %s", topicName, ms)
+			continue
+		}
+		cmd := protocol.NewCmdSimple()
+		cmd.CmdName = protocol.TAKEOVER_TOPIC_CMD
+		cmd.Args = append(cmd.Args, topicName)
+		cmd.Args = append(cmd.Args, ms)
+		err = msc.Send(link.JSON {
+			cmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			// give the topic back, so that it is failed over again
+			_, err = self.moveTopic(topicName, target.MsgServerAddr, ms)
+			if err != nil {
+				glog.Error(err.Error())
+			}
+			return
+		}
+		glog.Infof("topic %s moves from %s to %s", topicName, ms, target.MsgServerAddr)
+		target.TopicNum++
+	}
+}
+
+// Move the topic from the msg_server from to the msg_server to in the topic
+// store, if from still holds it.
+func (self *Manager)moveTopic(topicName string, from string, to string) (bool, error) {
+	self.topicMutex.Lock()
+	defer self.topicMutex.Unlock()
+	return self.topicStore.MoveTopic(topicName, from, to)
+}
+
+// Drop the devices on the dead msg_server ms from the session store, so
+// that its clients no longer look online. Only the clients in the session
+// index of ms are read.
+func (self *Manager)purgeMsgServerSessions(ms string) error {
+	ids, err := self.sessionStore.GetHostSessions(ms)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = self.purgeSession(id, ms)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *Manager)purgeSession(id string, ms string) error {
+	self.sessionMutex.Lock()
+	defer self.sessionMutex.Unlock()
+	sess, err := self.sessionStore.Get(id)
+	if err == nil {
+		for _, d := range append([]*storage.Device {}, sess.DeviceList...) {
+			if d.MsgServerAddr == ms {
+				sess.RemoveDevice(d.ID, d.MsgServerAddr)
+			}
+		}
+		if len(sess.DeviceList) == 0 && sess.MsgServerAddr == ms {
+			glog.Infof("purge session %s of %s", id, ms)
+			err = self.sessionStore.Delete(id)
+		} else {
+			err = self.sessionStore.Set(sess)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return self.sessionStore.RemoveHostSession(ms, id)
+}
+
+// Watch the msg_server registry and keep a subscribed link to every
+// registered msg_server.
+func (self *Manager)watchMsgServers() {
+	glog.Info("watchMsgServers")
+	timer := time.NewTicker(self.cfg.WatchInterval * time.Second)
+	for {
+		self.updateMsgServers()
+		<-timer.C
+	}
+}
@@ -0,0 +1,237 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// gopush-migrate moves the session and topic records written before key
+// namespaces existed, push:<id>, to push:session:<id> and push:topic:<name>.
+// Topics kept as one JSON string are rewritten into the metadata hash and
+// the member set the topic store uses now, and indexed by msg_server and by
+// member. Run it once while the cluster is
+// stopped.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+	"strings"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+	"github.com/oikomi/gopush/storage"
+)
+
+var (
+	RedisAddr = flag.String("redis", ":6379", "redis address")
+	KeyPrefix = flag.String("prefix", "push", "key prefix")
+	ScanCount = flag.Int("count", 1000, "keys asked for per SCAN")
+	DryRun    = flag.Bool("dry_run", false, "only print what would be moved")
+)
+
+type Migrator struct {
+	rs        *storage.RedisStore
+	topics    *storage.RedisTopicStore
+	moved     int
+	converted int
+	skipped   int
+	conflicts int
+}
+
+// Check whether the key, without the prefix, is already in a namespace.
+func namespaced(id string) bool {
+	for _, ns := range storage.Namespaces {
+		if id == ns || strings.HasPrefix(id, ns + ":") {
+			return true
+		}
+	}
+	return false
+}
+
+// Tell a session record from a topic record by its fields.
+func recordNamespace(b []byte) string {
+	var record map[string]interface{}
+	err := json.Unmarshal(b, &record)
+	if err != nil {
+		return ""
+	}
+	if _, ok := record["TopicName"]; ok {
+		return storage.NS_TOPIC
+	}
+	if _, ok := record["ClientID"]; ok {
+		return storage.NS_SESSION
+	}
+	return ""
+}
+
+// Rewrite a topic kept as one JSON string into a metadata hash and a member
+// set, and add it to the topic lists of its msg_server and its members. The
+// topic gets the default TTL again.
+func (self *Migrator)convertTopic(conn redis.Conn, key string, b []byte) error {
+	var t storage.TopicStoreData
+	err := json.Unmarshal(b, &t)
+	if err != nil {
+		fmt.Printf("skip %s : %s\n", key, err.Error())
+		self.skipped++
+		return nil
+	}
+	newKey := self.rs.Key(storage.NS_TOPIC, t.TopicName)
+	if *DryRun {
+		fmt.Printf("%s -> %s, %d members\n", key, newKey, len(t.MemberList))
+		self.converted++
+		return nil
+	}
+	// the hash may take the key of the string, so the string goes first, and
+	// all of it runs in one MULTI so that a failure loses nothing
+	conn.Send("MULTI")
+	conn.Send("DEL", key)
+	for _, m := range t.MemberList {
+		err = self.topics.SendAddMember(conn, t.TopicName, m)
+		if err != nil {
+			conn.Do("DISCARD")
+			return err
+		}
+	}
+	err = self.topics.SendSet(conn, &t)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	self.topics.SendIndexTopic(conn, &t)
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s -> %s, %d members\n", key, newKey, len(t.MemberList))
+	self.converted++
+	return nil
+}
+
+func (self *Migrator)migrateKey(conn redis.Conn, key string) error {
+	id := strings.TrimPrefix(key, self.rs.Prefix())
+	if strings.HasPrefix(id, storage.NS_TOPIC + ":") {
+		typ, err := redis.String(conn.Do("TYPE", key))
+		if err != nil || typ != "string" {
+			return err
+		}
+		b, err := redis.Bytes(conn.Do("GET", key))
+		if err != nil {
+			return err
+		}
+		return self.convertTopic(conn, key, b)
+	}
+	if namespaced(id) {
+		return nil
+	}
+	typ, err := redis.String(conn.Do("TYPE", key))
+	if err != nil {
+		return err
+	}
+	if typ != "string" {
+		fmt.Printf("skip %s : %s\n", key, typ)
+		self.skipped++
+		return nil
+	}
+	b, err := redis.Bytes(conn.Do("GET", key))
+	if err != nil {
+		return err
+	}
+	ns := recordNamespace(b)
+	if ns == "" {
+		fmt.Printf("skip %s : unknown record\n", key)
+		self.skipped++
+		return nil
+	}
+	
+	newKey := self.rs.Key(ns, id)
+	if ns == storage.NS_TOPIC {
+		exists, err := redis.Bool(conn.Do("EXISTS", newKey))
+		if err != nil {
+			return err
+		}
+		if exists {
+			fmt.Printf("conflict %s : %s exists\n", key, newKey)
+			self.conflicts++
+			return nil
+		}
+		return self.convertTopic(conn, key, b)
+	}
+	if *DryRun {
+		fmt.Printf("%s -> %s\n", key, newKey)
+		self.moved++
+		return nil
+	}
+	// RENAMENX keeps the TTL and never overwrites a newer record
+	ok, err := redis.Bool(conn.Do("RENAMENX", key, newKey))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Printf("conflict %s : %s exists\n", key, newKey)
+		self.conflicts++
+		return nil
+	}
+	fmt.Printf("%s -> %s\n", key, newKey)
+	self.moved++
+	return nil
+}
+
+func (self *Migrator)Run() error {
+	conn := self.rs.Get()
+	defer conn.Close()
+	
+	cursor := 0
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", self.rs.Prefix() + "*", "COUNT", *ScanCount))
+		if err != nil {
+			return err
+		}
+		cursor, err = redis.Int(reply[0], nil)
+		if err != nil {
+			return err
+		}
+		keys, err := redis.Strings(reply[1], nil)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			err = self.migrateKey(conn, key)
+			if err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	rs := storage.NewRedisStore(&storage.RedisStoreOptions {
+		Network        : "tcp",
+		Address        : *RedisAddr,
+		ConnectTimeout : 2 * time.Second,
+		ReadTimeout    : 10 * time.Second,
+		WriteTimeout   : 10 * time.Second,
+		KeyPrefix      : *KeyPrefix,
+	})
+	m := &Migrator {
+		rs     : rs,
+		topics : storage.NewRedisTopicStore(rs),
+	}
+	err := m.Run()
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+	fmt.Printf("%d moved, %d converted, %d skipped, %d conflicts\n", m.moved, m.converted, m.skipped, m.conflicts)
+}
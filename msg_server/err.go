@@ -1,24 +1,38 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package main
-
-import (
-	"errors"
-)
-
-var (
-	NOTOPIC = errors.New("NO TOPIC")
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+)
+
+var (
+	NOTOPIC = errors.New("NO TOPIC")
+	TOPICEXISTS = errors.New("TOPIC EXISTS")
+	NOCLIENTID = errors.New("NO CLIENT ID")
+	NOTAUTHPEER = errors.New("NOT AUTHORIZED PEER")
+	NOTCREATER = errors.New("NOT TOPIC CREATER")
+	NOTMEMBER = errors.New("NOT TOPIC MEMBER")
+	NOTADMIN = errors.New("NOT TOPIC ADMIN")
+	BANNED = errors.New("BANNED FROM TOPIC")
+	NOPUBLISH = errors.New("NOT ALLOWED TO PUBLISH")
+	BADROLE = errors.New("BAD TOPIC ROLE")
+	BADMODE = errors.New("BAD TOPIC MODE")
+	ALREADYLOGIN = errors.New("ALREADY LOGIN")
+	BADPRESENCE = errors.New("BAD PRESENCE")
+	BADARGS = errors.New("BAD ARGS")
+	NOCLIENTCERT = errors.New("INTERNAL LISTENER MUST REQUIRE CLIENT CERT")
 )
\ No newline at end of file
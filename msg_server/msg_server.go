@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/funny/link"
+	"github.com/oikomi/gopush/base"
+	"github.com/oikomi/gopush/common"
 )
 
 /*
@@ -55,6 +57,7 @@ func version() {
 var InputConfFile = flag.String("conf_file", "msg_server.json", "input conf file name")   
 
 func handleSession(ms *MsgServer, session *link.Session) {
+	ms.setReadDeadline(session)
 	session.ReadLoop(func(msg link.InBuffer) {
 		glog.Info(string(msg.Get()))
 		
@@ -62,7 +65,22 @@ func handleSession(ms *MsgServer, session *link.Session) {
 		if err != nil {
 			glog.Error(err.Error())
 		}
+		ms.setReadDeadline(session)
 	})
+	ms.removeSession(session)
+}
+
+// A session on the internal listener is a peer once the name on its client
+// certificate is one of the PeerNames.
+func handleInternalSession(ms *MsgServer, session *link.Session) {
+	err := common.VerifyPeerName(session.Conn(), ms.cfg.PeerNames)
+	if err != nil {
+		glog.Warningf("peer %s refused : %s", session.Conn().RemoteAddr().String(), err.Error())
+		session.Close(nil)
+		return
+	}
+	session.State = base.NewPeerState("")
+	handleSession(ms, session)
 }
 
 func main() {
@@ -80,14 +98,49 @@ func main() {
 	
 	p := link.PacketN(2, link.BigEndianBO, link.LittleEndianBF)
 	
-	ms.server, err = link.Listen(cfg.TransportProtocols, cfg.Listen, p)
+	ms.server, err = common.Listen(cfg.TransportProtocols, cfg.Listen, &cfg.TLS, p)
 	if err != nil {
 		panic(err)
 	}
 	glog.Info("server start:", ms.server.Listener().Addr().String())
 	
 	ms.createChannels()
+	ms.reclaimTopics()
 	go ms.scanDeadSession()
+	go ms.scanUnackedMsg()
+	go ms.registerMsgServer()
+	if cfg.HealthListen != "" {
+		go ms.serveHealth()
+	}
+	
+	if cfg.InternalListen != "" {
+		ms.internalServer, err = common.Listen(cfg.TransportProtocols, cfg.InternalListen, &cfg.InternalTLS, p)
+		if err != nil {
+			panic(err)
+		}
+		glog.Info("internal server start:", ms.internalServer.Listener().Addr().String())
+		
+		go ms.internalServer.AcceptLoop(func(session *link.Session) {
+			glog.Info("peer ", session.Conn().RemoteAddr().String(), " | in")
+			
+			go handleInternalSession(ms, session)
+		})
+	}
+	
+	if cfg.WsListen != "" {
+		wsListener, err := common.NewWsListener(cfg.WsListen, &cfg.TLS, cfg.WsOrigins)
+		if err != nil {
+			panic(err)
+		}
+		ms.wsServer = link.NewServer(wsListener, p)
+		glog.Info("websocket server start:", wsListener.Addr().String())
+		
+		go ms.wsServer.AcceptLoop(func(session *link.Session) {
+			glog.Info("web client ", session.Conn().RemoteAddr().String(), " | in")
+			
+			go handleSession(ms, session)
+		})
+	}
 
 	ms.server.AcceptLoop(func(session *link.Session) {
 		glog.Info("client ", session.Conn().RemoteAddr().String(), " | in")
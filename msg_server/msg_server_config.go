@@ -20,6 +20,14 @@ import (
 	"encoding/json"
 	"time"
 	"github.com/golang/glog"
+	"github.com/oikomi/gopush/common"
+)
+
+// What a msg_server does when a client ID logs in again.
+const (
+	LOGIN_POLICY_KICK    = "kick"
+	LOGIN_POLICY_REJECT  = "reject"
+	LOGIN_POLICY_MULTI   = "multi"
 )
 
 type MsgServerConfig struct {
@@ -27,9 +35,29 @@ type MsgServerConfig struct {
 	LocalIP                  string
 	TransportProtocols       string
 	Listen                   string
+	WsListen                 string
+	WsAddr                   string
+	WsOrigins                []string
+	HealthListen             string
+	HealthAddr               string
+	TLS                      common.TLSConfig
+	InternalListen           string
+	InternalAddr             string
+	InternalTLS              common.TLSConfig
+	PeerNames                []string
 	LogFile                  string
 	ScanDeadSessionTimeout   time.Duration
-	Expire                   time.Duration
+	SessionTimeout           time.Duration
+	OfflineMsgExpire         time.Duration
+	OfflineMsgMaxCount       int
+	AckTimeout               time.Duration
+	MaxAckRetries            int
+	RegisterInterval         time.Duration
+	RegisterTTL              time.Duration
+	Weight                   int
+	AuthSecret               string
+	PeerSecret               string
+	LoginPolicy              string
 	SessionManagerServerList []string
 	Redis struct { 
 		Addr string 
@@ -37,6 +65,9 @@ type MsgServerConfig struct {
 		ConnectTimeout time.Duration
 		ReadTimeout time.Duration
 		WriteTimeout time.Duration
+		MaxIdle int
+		MaxActive int
+		IdleTimeout time.Duration
 	} 
 }
 
@@ -59,6 +90,11 @@ func (self *MsgServerConfig)LoadConfig() error {
 	if err != nil {
 		return err
 	}
+	// peers on the internal listener are only known by their certificates
+	if self.InternalListen != "" && 
+		(!self.InternalTLS.Enable || self.InternalTLS.ClientAuth != common.CLIENT_AUTH_REQUIRE) {
+		return NOCLIENTCERT
+	}
 	return nil
 }
 
@@ -1,283 +1,1931 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package main
-
-import (
-	"flag"
-	"strconv"
-	"github.com/golang/glog"
-	"github.com/funny/link"
-	"github.com/oikomi/gopush/base"
-	"github.com/oikomi/gopush/protocol"
-	"github.com/oikomi/gopush/common"
-	"github.com/oikomi/gopush/storage"
-)
-
-func init() {
-	flag.Set("alsologtostderr", "true")
-	flag.Set("log_dir", "false")
-}
-
-type ProtoProc struct {
-	msgServer    *MsgServer
-}
-
-func NewProtoProc(msgServer *MsgServer) *ProtoProc {
-	return &ProtoProc {
-		msgServer : msgServer,
-	}
-}
-
-func (self *ProtoProc)procPing(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procPing")
-	cid := session.State.(*base.SessionState).ClientID
-	self.msgServer.scanSessionMutex.Lock()
-	defer self.msgServer.scanSessionMutex.Unlock()
-	self.msgServer.sessions[cid].State.(*base.SessionState).Alive = true
-	
-	return nil
-}
-
-func (self *ProtoProc)procClientID(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procClientID")
-	var err error
-	sessionStoreData := storage.NewSessionStoreData(cmd.GetArgs()[0], session.Conn().RemoteAddr().String(), 
-		self.msgServer.cfg.LocalIP, strconv.FormatUint(session.Id(), 10))
-		
-	glog.Info(sessionStoreData)
-	args := make([]string, 0)
-	args = append(args, cmd.GetArgs()[0])
-	CCmd := protocol.NewCmdInternal(protocol.STORE_SESSION_CMD, args, sessionStoreData)
-	
-	glog.Info(CCmd)
-	
-	if self.msgServer.channels[protocol.SYSCTRL_CLIENT_STATUS] != nil {
-		err = self.msgServer.channels[protocol.SYSCTRL_CLIENT_STATUS].Channel.Broadcast(link.JSON {
-			CCmd,
-		})
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-	}
-
-	self.msgServer.sessions[cmd.GetArgs()[0]] = session
-	self.msgServer.sessions[cmd.GetArgs()[0]].State = base.NewSessionState(true, cmd.GetArgs()[0])
-	
-	return nil
-}
-
-func (self *ProtoProc)procSendMessageP2P(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procSendMessageP2P")
-	var err error
-	send2ID := cmd.GetArgs()[0]
-	send2Msg := cmd.GetArgs()[1]
-	store_session, err := common.GetSessionFromCID(self.msgServer.sessionStore, send2ID)
-	if err != nil {
-		glog.Warningf("no ID : %s", send2ID)
-		
-		return err
-	}
-	
-	if store_session.MsgServerAddr == self.msgServer.cfg.LocalIP {
-		glog.Info("in the same server")
-		resp := protocol.NewCmdSimple()
-		resp.CmdName = protocol.RESP_MESSAGE_P2P_CMD
-		resp.Args = append(resp.Args, send2Msg)
-		
-		if self.msgServer.sessions[send2ID] != nil {
-			self.msgServer.sessions[send2ID].Send(link.JSON {
-				resp,
-			})
-			if err != nil {
-				glog.Fatalln(err.Error())
-			}
-		}
-	} else {
-		if self.msgServer.channels[protocol.SYSCTRL_SEND] != nil {
-			err = self.msgServer.channels[protocol.SYSCTRL_SEND].Channel.Broadcast(link.JSON {
-				cmd,
-			})
-			if err != nil {
-				glog.Error(err.Error())
-				return err
-			}
-		}
-	}
-	
-	return nil
-}
-
-func (self *ProtoProc)procRouteMessageP2P(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procRouteMessageP2P")
-	var err error
-	send2ID := cmd.GetArgs()[0]
-	send2Msg := cmd.GetArgs()[1]
-	_, err = common.GetSessionFromCID(self.msgServer.sessionStore, send2ID)
-	if err != nil {
-		glog.Warningf("no ID : %s", send2ID)
-		
-		return err
-	}
-
-	resp := protocol.NewCmdSimple()
-	resp.CmdName = protocol.RESP_MESSAGE_P2P_CMD
-	resp.Args = append(resp.Args, send2Msg)
-	
-	if self.msgServer.sessions[send2ID] != nil {
-		self.msgServer.sessions[send2ID].Send(link.JSON {
-			resp,
-		})
-		if err != nil {
-			glog.Fatalln(err.Error())
-		}
-	}
-
-	return nil
-}
-
-
-func (self *ProtoProc)procSendMessageTopic(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procSendMessageTopic")
-	var err error
-	topicName := cmd.GetArgs()[0]
-	send2Msg := cmd.GetArgs()[1]
-	glog.Info(send2Msg)
-	glog.Info(topicName)
-
-	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC] != nil {
-		err = self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC].Channel.Broadcast(link.JSON {
-			cmd,
-		})
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-	}
-	
-	return nil
-}
-
-func (self *ProtoProc)procSubscribeChannel(cmd protocol.Cmd, session *link.Session) {
-	glog.Info("procSubscribeChannel")
-	channelName := cmd.GetArgs()[0]
-	cUUID := cmd.GetArgs()[1]
-	glog.Info(channelName)
-	if self.msgServer.channels[channelName] != nil {
-		self.msgServer.channels[channelName].Channel.Join(session, nil)
-		self.msgServer.channels[channelName].ClientIDlist = append(self.msgServer.channels[channelName].ClientIDlist, cUUID)
-	} else {
-		glog.Warning(channelName + " is not exist")
-	}
-}
-
-func (self *ProtoProc)procCreateTopic(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procCreateTopic")
-	var err error
-	topicName := cmd.GetArgs()[0]
-	
-	topicStoreData := storage.NewTopicStoreData(topicName, session.State.(*base.SessionState).ClientID, 
-		self.msgServer.cfg.LocalIP)
-
-	t := protocol.NewTopic(topicName, self.msgServer.cfg.LocalIP, session.State.(*base.SessionState).ClientID, session)
-	t.ClientIDList = append(t.ClientIDList, session.State.(*base.SessionState).ClientID)
-	t.TSD = topicStoreData
-	self.msgServer.topics[topicName] = t
-	
-
-	glog.Info(topicStoreData)
-	args := make([]string, 0)
-	args = append(args, topicName)
-	CCmd := protocol.NewCmdInternal(protocol.STORE_TOPIC_CMD, args, topicStoreData)
-	m := storage.NewMember(session.State.(*base.SessionState).ClientID)
-	CCmd.AnyData.(*storage.TopicStoreData).MemberList = append(CCmd.AnyData.(*storage.TopicStoreData).MemberList, m)
-	
-	glog.Info(CCmd)
-	
-	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS] != nil {
-		err = self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS].Channel.Broadcast(link.JSON {
-			CCmd,
-		})
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-	}
-	
-	return nil
-}
-
-func (self *ProtoProc)findTopicMsgAddr(topicName string) (*storage.TopicStoreData, error) {
-	glog.Info("findTopicMsgAddr")
-	t, err := common.GetTopicFromTopicName(self.msgServer.topicStore, topicName)
-	
-	return t, err
-}
-
-func (self *ProtoProc)procJoinTopic(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procJoinTopic")
-	var err error
-	topicName := cmd.GetArgs()[0]
-	
-	if self.msgServer.topics[topicName] == nil {
-		glog.Warning("no topic :" + topicName)
-		t, err := self.findTopicMsgAddr(topicName)
-		if err != nil {
-			glog.Warningf("no topicName : %s", topicName)
-			return err
-		}
-		
-		resp := protocol.NewCmdSimple()
-		resp.CmdName = protocol.LOCATE_TOPIC_MSG_ADDR_CMD
-		resp.Args = append(resp.Args, t.MsgServerAddr)
-		
-		err = session.Send(link.JSON {
-			resp,
-		})
-		
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-		
-		return err
-	}
-	
-	m := storage.NewMember(session.State.(*base.SessionState).ClientID)
-
-	self.msgServer.topics[topicName].ClientIDList = append(self.msgServer.topics[topicName].ClientIDList, 
-		session.State.(*base.SessionState).ClientID)
-	
-	self.msgServer.topics[topicName].AddMember(m)
-	
-	args := make([]string, 0)
-	args = append(args, topicName)
-	CCmd := protocol.NewCmdInternal(protocol.STORE_TOPIC_CMD, args, self.msgServer.topics[topicName].TSD)
-	
-	glog.Info(CCmd)
-	
-	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS] != nil {
-		err = self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS].Channel.Broadcast(link.JSON {
-			CCmd,
-		})
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-	}
-	
-	return nil
-}
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"time"
+	"flag"
+	"strconv"
+	"github.com/golang/glog"
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/base"
+	"github.com/oikomi/gopush/protocol"
+	"github.com/oikomi/gopush/common"
+	"github.com/oikomi/gopush/storage"
+)
+
+func init() {
+	flag.Set("alsologtostderr", "true")
+	flag.Set("log_dir", "false")
+}
+
+type ProtoProc struct {
+	msgServer    *MsgServer
+}
+
+func NewProtoProc(msgServer *MsgServer) *ProtoProc {
+	return &ProtoProc {
+		msgServer : msgServer,
+	}
+}
+
+func (self *ProtoProc)procPing(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procPing")
+	self.msgServer.sessionMutex.Lock()
+	session.State.(*base.SessionState).Alive = true
+	self.msgServer.sessionMutex.Unlock()
+	
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_PING_CMD
+	resp.Args = append(resp.Args, protocol.PONG)
+	
+	err := session.Send(link.JSON {
+		resp,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return nil
+}
+
+// Tell the client why it is rejected and close its session.
+func (self *ProtoProc)rejectSession(session *link.Session, reason string) {
+	glog.Info("rejectSession")
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.AUTH_FAILED_CMD
+	resp.Args = append(resp.Args, reason)
+	
+	err := session.Send(link.JSON {
+		resp,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+	}
+	session.Close(nil)
+}
+
+func (self *ProtoProc)procClientID(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procClientID")
+	if len(cmd.GetArgs()) < 1 {
+		return BADARGS
+	}
+	// a session logs in once, a second login would leave its first client
+	// in the devices, and a peer is never a client
+	if session.State != nil {
+		glog.Warningf("%s sends a client id again", session.Conn().RemoteAddr().String())
+		return ALREADYLOGIN
+	}
+	var err error
+	if self.msgServer.cfg.AuthSecret != "" {
+		token := ""
+		if len(cmd.GetArgs()) > 1 {
+			token = cmd.GetArgs()[1]
+		}
+		err = common.VerifyToken(self.msgServer.cfg.AuthSecret, cmd.GetArgs()[0], token)
+		if err != nil {
+			glog.Warningf("client %s auth failed : %s", cmd.GetArgs()[0], err.Error())
+			self.rejectSession(session, err.Error())
+			return err
+		}
+	}
+	
+	err = self.checkLogin(cmd.GetArgs()[0], session)
+	if err != nil {
+		glog.Warningf("client %s login failed : %s", cmd.GetArgs()[0], err.Error())
+		self.rejectSession(session, err.Error())
+		return err
+	}
+	
+	sessionStoreData := storage.NewSessionStoreData(cmd.GetArgs()[0], session.Conn().RemoteAddr().String(), 
+		self.msgServer.cfg.LocalIP, strconv.FormatUint(session.Id(), 10))
+		
+	glog.Info(sessionStoreData)
+	args := make([]string, 0)
+	args = append(args, cmd.GetArgs()[0])
+	storeCmdName := protocol.STORE_SESSION_CMD
+	if self.msgServer.cfg.LoginPolicy == LOGIN_POLICY_MULTI {
+		storeCmdName = protocol.STORE_DEVICE_CMD
+	}
+	CCmd := protocol.NewCmdInternal(storeCmdName, args, sessionStoreData)
+	
+	glog.Info(CCmd)
+	
+	if self.msgServer.channels[protocol.SYSCTRL_CLIENT_STATUS] != nil {
+		err = self.msgServer.channels[protocol.SYSCTRL_CLIENT_STATUS].Channel.Broadcast(link.JSON {
+			CCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+
+	self.msgServer.addSession(cmd.GetArgs()[0], session)
+	
+	// the client waits for this before it takes any other command
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_CLIENT_ID_CMD
+	resp.Args = append(resp.Args, cmd.GetArgs()[0])
+	err = session.Send(link.JSON {
+		resp,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	err = self.setPresence(cmd.GetArgs()[0], protocol.PRESENCE_ONLINE, "")
+	if err != nil {
+		glog.Error(err.Error())
+	}
+	
+	err = self.replayOfflineMsg(cmd.GetArgs()[0], session)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	self.rejoinTopics(session)
+	
+	return nil
+}
+
+// Apply the login policy to a client ID that is already logged in, here
+// or on another live msg_server.
+func (self *ProtoProc)checkLogin(clientID string, session *link.Session) error {
+	if self.msgServer.cfg.LoginPolicy == LOGIN_POLICY_MULTI {
+		return nil
+	}
+	
+	online := false
+	for _, s := range self.msgServer.clientSessions(clientID) {
+		if s != session && !s.IsClosed() {
+			online = true
+		}
+	}
+	remoteAddr := ""
+	store_session, err := common.GetSessionFromCID(self.msgServer.sessionStore, clientID)
+	if err == nil && store_session.MsgServerAddr != self.msgServer.cfg.LocalIP {
+		_, err = self.msgServer.msgServerStore.Get(store_session.MsgServerAddr)
+		if err == nil {
+			remoteAddr = store_session.MsgServerAddr
+		}
+	}
+	if !online && remoteAddr == "" {
+		return nil
+	}
+	
+	if self.msgServer.cfg.LoginPolicy == LOGIN_POLICY_REJECT {
+		return ALREADYLOGIN
+	}
+	if online {
+		self.kickClient(clientID, session)
+	}
+	if remoteAddr != "" && self.msgServer.channels[protocol.SYSCTRL_SEND] != nil {
+		routeCmd := protocol.NewCmdSimple()
+		routeCmd.CmdName = protocol.KICK_CLIENT_CMD
+		routeCmd.Args = append(routeCmd.Args, clientID)
+		routeCmd.Args = append(routeCmd.Args, remoteAddr)
+		
+		err = self.msgServer.channels[protocol.SYSCTRL_SEND].Channel.Broadcast(link.JSON {
+			routeCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+	
+	return nil
+}
+
+// Close every session of the client on this msg_server except keep, with
+// a KICKED notice.
+func (self *ProtoProc)kickClient(clientID string, keep *link.Session) {
+	glog.Info("kickClient")
+	notice := protocol.NewCmdSimple()
+	notice.CmdName = protocol.KICKED_CMD
+	notice.Args = append(notice.Args, ALREADYLOGIN.Error())
+	
+	for _, s := range self.msgServer.clientSessions(clientID) {
+		if s == keep {
+			continue
+		}
+		err := s.Send(link.JSON {
+			notice,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+		}
+		s.Close(nil)
+		self.msgServer.removeSession(s)
+	}
+}
+
+// The client has logged in on another msg_server.
+func (self *ProtoProc)procRouteKickClient(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procRouteKickClient")
+	self.kickClient(cmd.GetArgs()[0], nil)
+	
+	return nil
+}
+
+func (self *ProtoProc)storeOfflineMsg(msgID string, send2ID string, fromID string, send2Msg string) error {
+	glog.Info("storeOfflineMsg")
+	msg := storage.NewOfflineMsgData(msgID, send2ID, fromID, send2Msg)
+	err := self.msgServer.offlineMsgStore.Push(msg, self.msgServer.cfg.OfflineMsgExpire * time.Second, 
+		self.msgServer.cfg.OfflineMsgMaxCount)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return self.sendDeliveryReport(fromID, msgID, send2ID, protocol.DELIVERY_STATUS_OFFLINE)
+}
+
+// Deliver the offline messages of the client. A message leaves the inbox
+// only once it is handed to sendP2PMsgLocal, which keeps it pending until it
+// is acked, so the messages after a failed one wait for the next login.
+func (self *ProtoProc)replayOfflineMsg(clientID string, session *link.Session) error {
+	glog.Info("replayOfflineMsg")
+	msgs, err := self.msgServer.offlineMsgStore.Peek(clientID, self.msgServer.cfg.OfflineMsgExpire * time.Second)
+	if err != nil {
+		return err
+	}
+	
+	for _, msg := range msgs {
+		if msg.TopicName != "" {
+			err = self.sendOfflineTopicMsg(msg, session)
+		} else {
+			err = self.sendP2PMsgLocal(msg.MsgID, clientID, msg.FromID, msg.Msg)
+		}
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+		err = self.msgServer.offlineMsgStore.Remove(msg)
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Topic messages are not acked, so they are sent once.
+func (self *ProtoProc)sendOfflineTopicMsg(msg *storage.OfflineMsgData, session *link.Session) error {
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_MESSAGE_TOPIC_CMD
+	resp.Args = append(resp.Args, msg.TopicName)
+	resp.Args = append(resp.Args, msg.Msg)
+	resp.Args = append(resp.Args, msg.FromID)
+	
+	return session.Send(link.JSON {
+		resp,
+	})
+}
+
+// Send a P2P message to a client connected to this msg_server and keep it
+// pending until the client acks it. The message is moved to the offline
+// store if the client is not here.
+func (self *ProtoProc)sendP2PMsgLocal(msgID string, send2ID string, fromID string, send2Msg string) error {
+	glog.Info("sendP2PMsgLocal")
+	sessions := self.msgServer.clientSessions(send2ID)
+	if len(sessions) == 0 {
+		return self.storeOfflineMsg(msgID, send2ID, fromID, send2Msg)
+	}
+	
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_MESSAGE_P2P_CMD
+	resp.Args = append(resp.Args, send2Msg)
+	resp.Args = append(resp.Args, fromID)
+	resp.Args = append(resp.Args, msgID)
+	
+	self.msgServer.pendingMsgMutex.Lock()
+	self.msgServer.pendingMsgs[msgID] = base.NewPendingMsg(msgID, fromID, send2ID, send2Msg)
+	self.msgServer.pendingMsgMutex.Unlock()
+	
+	for _, s := range sessions {
+		err := s.Send(link.JSON {
+			resp,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)resendPendingMsg(p *base.PendingMsg) error {
+	glog.Info("resendPendingMsg")
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_MESSAGE_P2P_CMD
+	resp.Args = append(resp.Args, p.Msg)
+	resp.Args = append(resp.Args, p.FromID)
+	resp.Args = append(resp.Args, p.MsgID)
+	
+	self.msgServer.pendingMsgMutex.Lock()
+	p.Retries = p.Retries + 1
+	p.LastSend = time.Now()
+	self.msgServer.pendingMsgMutex.Unlock()
+	
+	for _, s := range self.msgServer.clientSessions(p.ToID) {
+		err := s.Send(link.JSON {
+			resp,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Report the delivery status of msgID to its sender, through the router if
+// the sender is not connected to this msg_server.
+func (self *ProtoProc)sendDeliveryReport(fromID string, msgID string, send2ID string, status string) error {
+	glog.Info("sendDeliveryReport")
+	var err error
+	if fromID == "" {
+		return nil
+	}
+	
+	if s := self.msgServer.getSession(fromID); s != nil {
+		resp := protocol.NewCmdSimple()
+		resp.CmdName = protocol.DELIVERY_REPORT_CMD
+		resp.Args = append(resp.Args, msgID)
+		resp.Args = append(resp.Args, send2ID)
+		resp.Args = append(resp.Args, status)
+		
+		err = s.Send(link.JSON {
+			resp,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+		
+		return nil
+	}
+	
+	if self.msgServer.channels[protocol.SYSCTRL_SEND] != nil {
+		routeCmd := protocol.NewCmdSimple()
+		routeCmd.CmdName = protocol.DELIVERY_REPORT_CMD
+		routeCmd.Args = append(routeCmd.Args, msgID)
+		routeCmd.Args = append(routeCmd.Args, send2ID)
+		routeCmd.Args = append(routeCmd.Args, status)
+		routeCmd.Args = append(routeCmd.Args, fromID)
+		
+		err = self.msgServer.channels[protocol.SYSCTRL_SEND].Channel.Broadcast(link.JSON {
+			routeCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Deliver a P2P message here, or through the router to the msg_servers of
+// send2ID. SENT is reported once the message is on its way to an online
+// client, OFFLINE once it is in the inbox instead.
+func (self *ProtoProc)procSendMessageP2P(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procSendMessageP2P")
+	var err error
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	send2ID := cmd.GetArgs()[0]
+	send2Msg := cmd.GetArgs()[1]
+	fromID := session.State.(*base.SessionState).ClientID
+	msgID := self.msgServer.newMsgID()
+	
+	store_session, err := common.GetSessionFromCID(self.msgServer.sessionStore, send2ID)
+	if err != nil {
+		glog.Warningf("no ID : %s", send2ID)
+		
+		return self.storeOfflineMsg(msgID, send2ID, fromID, send2Msg)
+	}
+	
+	// the router fans out to every msg_server with a device of send2ID
+	addrs := store_session.MsgServerAddrs()
+	if len(addrs) == 1 && addrs[0] == self.msgServer.cfg.LocalIP {
+		glog.Info("in the same server")
+		if len(self.msgServer.clientSessions(send2ID)) == 0 {
+			return self.storeOfflineMsg(msgID, send2ID, fromID, send2Msg)
+		}
+		err = self.sendDeliveryReport(fromID, msgID, send2ID, protocol.DELIVERY_STATUS_SENT)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+		
+		return self.sendP2PMsgLocal(msgID, send2ID, fromID, send2Msg)
+	}
+	
+	if self.msgServer.channels[protocol.SYSCTRL_SEND] == nil {
+		glog.Warning("no router")
+		return self.storeOfflineMsg(msgID, send2ID, fromID, send2Msg)
+	}
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.SEND_MESSAGE_P2P_CMD
+	routeCmd.Args = append(routeCmd.Args, send2ID)
+	routeCmd.Args = append(routeCmd.Args, send2Msg)
+	routeCmd.Args = append(routeCmd.Args, fromID)
+	routeCmd.Args = append(routeCmd.Args, msgID)
+	
+	err = self.msgServer.channels[protocol.SYSCTRL_SEND].Channel.Broadcast(link.JSON {
+		routeCmd,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return self.storeOfflineMsg(msgID, send2ID, fromID, send2Msg)
+	}
+	
+	return self.sendDeliveryReport(fromID, msgID, send2ID, protocol.DELIVERY_STATUS_SENT)
+}
+
+func (self *ProtoProc)procRouteMessageP2P(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procRouteMessageP2P")
+	if len(cmd.GetArgs()) < 4 {
+		return BADARGS
+	}
+	send2ID := cmd.GetArgs()[0]
+	send2Msg := cmd.GetArgs()[1]
+	fromID := cmd.GetArgs()[2]
+	msgID := cmd.GetArgs()[3]
+
+	return self.sendP2PMsgLocal(msgID, send2ID, fromID, send2Msg)
+}
+
+func (self *ProtoProc)procRouteMessageBroadcast(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procRouteMessageBroadcast")
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	send2Msg := cmd.GetArgs()[0]
+	fromID := cmd.GetArgs()[1]
+	
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_MESSAGE_BROADCAST_CMD
+	resp.Args = append(resp.Args, send2Msg)
+	resp.Args = append(resp.Args, fromID)
+	
+	self.msgServer.sessionMutex.Lock()
+	devices := make(base.DeviceMap)
+	for id, sessions := range self.msgServer.devices {
+		devices[id] = append([]*link.Session {}, sessions...)
+	}
+	self.msgServer.sessionMutex.Unlock()
+	
+	for id, sessions := range devices {
+		for _, s := range sessions {
+			err := s.Send(link.JSON {
+				resp,
+			})
+			if err != nil {
+				glog.Warningf("broadcast to %s failed : %s", id, err.Error())
+			}
+		}
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procAckMessage(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procAckMessage")
+	if len(cmd.GetArgs()) < 1 {
+		return BADARGS
+	}
+	msgID := cmd.GetArgs()[0]
+	cid := session.State.(*base.SessionState).ClientID
+	
+	self.msgServer.pendingMsgMutex.Lock()
+	p := self.msgServer.pendingMsgs[msgID]
+	if p == nil || p.ToID != cid {
+		self.msgServer.pendingMsgMutex.Unlock()
+		glog.Warningf("no pending msg : %s", msgID)
+		return nil
+	}
+	delete(self.msgServer.pendingMsgs, msgID)
+	self.msgServer.pendingMsgMutex.Unlock()
+	
+	return self.sendDeliveryReport(p.FromID, msgID, p.ToID, protocol.DELIVERY_STATUS_DELIVERED)
+}
+
+func (self *ProtoProc)procRouteDeliveryReport(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procRouteDeliveryReport")
+	if len(cmd.GetArgs()) < 4 {
+		return BADARGS
+	}
+	msgID := cmd.GetArgs()[0]
+	send2ID := cmd.GetArgs()[1]
+	status := cmd.GetArgs()[2]
+	fromID := cmd.GetArgs()[3]
+	
+	if self.msgServer.getSession(fromID) == nil {
+		glog.Warningf("no ID : %s", fromID)
+		return nil
+	}
+	
+	return self.sendDeliveryReport(fromID, msgID, send2ID, status)
+}
+
+func (self *ProtoProc)sendTopicMsgLocal(topicName string, resp *protocol.CmdSimple) error {
+	glog.Info("sendTopicMsgLocal")
+	var err error
+	self.msgServer.topicMutex.Lock()
+	t := self.msgServer.topics[topicName]
+	self.msgServer.topicMutex.Unlock()
+	if t != nil {
+		err = t.Channel.Broadcast(link.JSON {
+			resp,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+		
+		return self.sendTopicMsgNoAddr(t, resp)
+	}
+	
+	// the members are read a page at a time, large topics never load at once
+	var cursor uint64
+	for {
+		members, next, err := self.msgServer.topicStore.ScanMembers(topicName, cursor, common.TopicMemberPage)
+		if err != nil {
+			glog.Warningf("no topicName : %s", topicName)
+			return err
+		}
+		for _, m := range members {
+			if m.MsgServerAddr != "" && m.MsgServerAddr != self.msgServer.cfg.LocalIP {
+				continue
+			}
+			if s := self.msgServer.getSession(m.ID); s != nil {
+				err = s.Send(link.JSON {
+					resp,
+				})
+				if err != nil {
+					glog.Error(err.Error())
+				}
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// The members of a taken over topic that were on the dead msg_server have
+// no msg_server until they log in again. They get the message if they are
+// here, keep it offline if they are nowhere, and get it from their new
+// msg_server otherwise.
+func (self *ProtoProc)sendTopicMsgNoAddr(t *protocol.Topic, resp *protocol.CmdSimple) error {
+	ids := make([]string, 0)
+	self.msgServer.topicMutex.Lock()
+	for _, m := range t.TSD.MemberList {
+		if m.MsgServerAddr == "" {
+			ids = append(ids, m.ID)
+		}
+	}
+	self.msgServer.topicMutex.Unlock()
+	
+	for _, id := range ids {
+		if s := self.msgServer.getSession(id); s != nil {
+			err := s.Send(link.JSON {
+				resp,
+			})
+			if err != nil {
+				glog.Error(err.Error())
+			}
+			continue
+		}
+		_, err := common.GetSessionFromCID(self.msgServer.sessionStore, id)
+		if err == nil {
+			continue
+		}
+		msg := storage.NewOfflineMsgData(self.msgServer.newMsgID(), id, resp.Args[2], resp.Args[1])
+		msg.TopicName = resp.Args[0]
+		err = self.msgServer.offlineMsgStore.Push(msg, self.msgServer.cfg.OfflineMsgExpire * time.Second, 
+			self.msgServer.cfg.OfflineMsgMaxCount)
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procSendMessageTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procSendMessageTopic")
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	var err error
+	topicName := cmd.GetArgs()[0]
+	send2Msg := cmd.GetArgs()[1]
+	fromID := session.State.(*base.SessionState).ClientID
+	glog.Info(send2Msg)
+	glog.Info(topicName)
+	
+	var canPublish bool
+	self.msgServer.topicMutex.Lock()
+	t := self.msgServer.topics[topicName]
+	if t != nil {
+		canPublish = t.TSD.CanPublish(fromID)
+	}
+	self.msgServer.topicMutex.Unlock()
+	if t == nil {
+		tsd, err := self.findTopicMsgAddr(topicName)
+		if err != nil {
+			return self.sendTopicResult(protocol.RESP_SEND_MESSAGE_TOPIC_CMD, topicName, NOTOPIC, 
+				self.localTopicClient(session))
+		}
+		// only the sender is needed to check its role
+		m, err := self.msgServer.topicStore.GetMember(topicName, fromID)
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+		if m != nil {
+			tsd.AddMember(m)
+		}
+		canPublish = tsd.CanPublish(fromID)
+	}
+	if !canPublish {
+		glog.Warningf("%s can not publish to %s", fromID, topicName)
+		return self.sendTopicResult(protocol.RESP_SEND_MESSAGE_TOPIC_CMD, topicName, NOPUBLISH, 
+			self.localTopicClient(session))
+	}
+	
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_MESSAGE_TOPIC_CMD
+	resp.Args = append(resp.Args, topicName)
+	resp.Args = append(resp.Args, send2Msg)
+	resp.Args = append(resp.Args, fromID)
+	
+	err = self.sendTopicMsgLocal(topicName, resp)
+	if err != nil {
+		return err
+	}
+
+	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC] != nil {
+		routeCmd := protocol.NewCmdSimple()
+		routeCmd.CmdName = protocol.SEND_MESSAGE_TOPIC_CMD
+		routeCmd.Args = append(routeCmd.Args, topicName)
+		routeCmd.Args = append(routeCmd.Args, send2Msg)
+		routeCmd.Args = append(routeCmd.Args, fromID)
+		routeCmd.Args = append(routeCmd.Args, self.msgServer.cfg.LocalIP)
+		
+		err = self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC].Channel.Broadcast(link.JSON {
+			routeCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procRouteMessageTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procRouteMessageTopic")
+	if len(cmd.GetArgs()) < 3 {
+		return BADARGS
+	}
+	topicName := cmd.GetArgs()[0]
+	send2Msg := cmd.GetArgs()[1]
+	fromID := cmd.GetArgs()[2]
+	
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_MESSAGE_TOPIC_CMD
+	resp.Args = append(resp.Args, topicName)
+	resp.Args = append(resp.Args, send2Msg)
+	resp.Args = append(resp.Args, fromID)
+	
+	return self.sendTopicMsgLocal(topicName, resp)
+}
+
+// Hand out a nonce for the peer on session to sign its token with.
+func (self *ProtoProc)procPeerNonce(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procPeerNonce")
+	nonce, err := common.NewNonce()
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	switch session.State.(type) {
+		case nil, *base.PeerNonceState:
+			session.State = base.NewPeerNonceState(nonce)
+	}
+	
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_PEER_NONCE_CMD
+	resp.Args = append(resp.Args, nonce)
+	
+	err = session.Send(link.JSON {
+		resp,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return nil
+}
+
+// A peer is authorized by the internal listener, which checked the name on
+// its client certificate, or else by a token signed with the peer secret over
+// the nonce of this session. Once there is an internal listener peers must
+// come in through it.
+func (self *ProtoProc)authPeer(session *link.Session, cUUID string, token string) error {
+	if _, ok := session.State.(*base.PeerState); ok {
+		return nil
+	}
+	if self.msgServer.cfg.InternalListen != "" || self.msgServer.cfg.PeerSecret == "" {
+		return NOTAUTHPEER
+	}
+	state, ok := session.State.(*base.PeerNonceState)
+	if !ok {
+		return NOTAUTHPEER
+	}
+	
+	return common.VerifyToken(self.msgServer.cfg.PeerSecret, common.PeerTokenID(cUUID, state.Nonce), token)
+}
+
+func (self *ProtoProc)procSubscribeChannel(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procSubscribeChannel")
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	channelName := cmd.GetArgs()[0]
+	cUUID := cmd.GetArgs()[1]
+	token := ""
+	if len(cmd.GetArgs()) > 2 {
+		token = cmd.GetArgs()[2]
+	}
+	glog.Info(channelName)
+	
+	err := self.authPeer(session, cUUID, token)
+	if err != nil {
+		glog.Warningf("peer %s subscribe %s failed : %s", cUUID, channelName, err.Error())
+		self.rejectSession(session, err.Error())
+		return err
+	}
+	session.State = base.NewPeerState(cUUID)
+	
+	if self.msgServer.channels[channelName] != nil {
+		self.msgServer.channels[channelName].Channel.Join(session, nil)
+		for _, id := range self.msgServer.channels[channelName].ClientIDlist {
+			if id == cUUID {
+				// resubscribe after the peer reconnected
+				return nil
+			}
+		}
+		self.msgServer.channels[channelName].ClientIDlist = append(self.msgServer.channels[channelName].ClientIDlist, cUUID)
+	} else {
+		glog.Warning(channelName + " is not exist")
+	}
+	
+	return nil
+}
+
+// Create a topic owned by the client. A topic that exists here or on
+// another msg_server is not taken over.
+func (self *ProtoProc)procCreateTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procCreateTopic")
+	var err error
+	client := self.localTopicClient(session)
+	if len(cmd.GetArgs()) < 1 {
+		return self.sendTopicResult(protocol.RESP_CREATE_TOPIC_CMD, "", BADARGS, client)
+	}
+	topicName := cmd.GetArgs()[0]
+	
+	topicStoreData := storage.NewTopicStoreData(topicName, session.State.(*base.SessionState).ClientID, 
+		self.msgServer.cfg.LocalIP)
+	if len(cmd.GetArgs()) > 1 {
+		if !storage.IsTopicMode(cmd.GetArgs()[1]) {
+			glog.Warningf("bad topic mode : %s", cmd.GetArgs()[1])
+			return self.sendTopicResult(protocol.RESP_CREATE_TOPIC_CMD, topicName, BADMODE, client)
+		}
+		topicStoreData.Mode = cmd.GetArgs()[1]
+	}
+
+	self.msgServer.topicMutex.Lock()
+	defer self.msgServer.topicMutex.Unlock()
+	if self.msgServer.topics[topicName] != nil {
+		glog.Warningf("topic %s exists", topicName)
+		return self.sendTopicResult(protocol.RESP_CREATE_TOPIC_CMD, topicName, TOPICEXISTS, client)
+	}
+	_, err = self.msgServer.topicStore.Get(topicName)
+	if err == nil {
+		glog.Warningf("topic %s exists", topicName)
+		return self.sendTopicResult(protocol.RESP_CREATE_TOPIC_CMD, topicName, TOPICEXISTS, client)
+	}
+	if err != storage.ErrNotFound {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	t := protocol.NewTopic(topicName, self.msgServer.cfg.LocalIP, session.State.(*base.SessionState).ClientID, session)
+	t.Channel = link.NewChannel(self.msgServer.server.Protocol())
+	t.Channel.Join(session, nil)
+	t.ClientIDList = append(t.ClientIDList, session.State.(*base.SessionState).ClientID)
+	t.TSD = topicStoreData
+	m := storage.NewMember(session.State.(*base.SessionState).ClientID)
+	m.Role = storage.TOPIC_ROLE_OWNER
+	m.MsgServerAddr = self.msgServer.cfg.LocalIP
+	t.AddMember(m)
+	self.msgServer.topics[topicName] = t
+	
+
+	glog.Info(topicStoreData)
+	err = self.storeTopicMember(protocol.STORE_TOPIC_MEMBER_CMD, topicName, m)
+	if err != nil {
+		return err
+	}
+	err = self.storeTopic(t)
+	if err != nil {
+		return err
+	}
+	err = self.syncTopic(protocol.CREATE_TOPIC_CMD, topicName)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_CREATE_TOPIC_CMD, topicName, nil, client)
+}
+
+// Tell the routers that the topic is created on or deleted from this msg_server.
+func (self *ProtoProc)syncTopic(cmdName string, topicName string) error {
+	args := make([]string, 0)
+	args = append(args, topicName)
+	CCmd := protocol.NewCmdInternal(cmdName, args, self.msgServer.cfg.LocalIP)
+	
+	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC] != nil {
+		err := self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC].Channel.Broadcast(link.JSON {
+			CCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Save the metadata of a local topic. Its members are saved one by one by
+// storeTopicMember.
+func (self *ProtoProc)storeTopic(t *protocol.Topic) error {
+	args := make([]string, 0)
+	args = append(args, t.TopicName)
+	CCmd := protocol.NewCmdInternal(protocol.STORE_TOPIC_CMD, args, t.TSD)
+	
+	glog.Info(CCmd)
+	
+	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS] != nil {
+		err := self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS].Channel.Broadcast(link.JSON {
+			CCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// Tell the manager that a member of a local topic is added or updated, with
+// STORE_TOPIC_MEMBER, or removed, with DELETE_TOPIC_MEMBER.
+func (self *ProtoProc)storeTopicMember(cmdName string, topicName string, m *storage.Member) error {
+	args := make([]string, 0)
+	args = append(args, topicName)
+	CCmd := protocol.NewCmdInternal(cmdName, args, m)
+	
+	glog.Info(CCmd)
+	
+	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS] != nil {
+		err := self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS].Channel.Broadcast(link.JSON {
+			CCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// TopicClient is the client a topic command comes from. Session is nil when
+// the client is connected to another msg_server and the command is routed here.
+type TopicClient struct {
+	ID            string
+	MsgServerAddr string
+	Session       *link.Session
+}
+
+func (self *ProtoProc)localTopicClient(session *link.Session) *TopicClient {
+	return &TopicClient {
+		ID            : session.State.(*base.SessionState).ClientID,
+		MsgServerAddr : self.msgServer.cfg.LocalIP,
+		Session       : session,
+	}
+}
+
+// Find the client wherever it is connected.
+func (self *ProtoProc)findTopicClient(clientID string) (*TopicClient, error) {
+	if s := self.msgServer.getSession(clientID); s != nil {
+		return self.localTopicClient(s), nil
+	}
+	store_session, err := common.GetSessionFromCID(self.msgServer.sessionStore, clientID)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicClient {
+		ID            : clientID,
+		MsgServerAddr : store_session.MsgServerAddr,
+	}, nil
+}
+
+// Send resp to the client if it is connected here, otherwise ask the router
+// to deliver it to msgServerAddr.
+func (self *ProtoProc)sendToClient(clientID string, msgServerAddr string, resp *protocol.CmdSimple) error {
+	if msgServerAddr == "" || msgServerAddr == self.msgServer.cfg.LocalIP {
+		s := self.msgServer.getSession(clientID)
+		if s == nil {
+			glog.Warningf("no ID : %s", clientID)
+			return nil
+		}
+		return s.Send(link.JSON {
+			resp,
+		})
+	}
+	
+	fwd := protocol.NewCmdSimple()
+	fwd.CmdName = protocol.FORWARD_TOPIC_REPLY_CMD
+	fwd.Args = append(fwd.Args, msgServerAddr)
+	fwd.Args = append(fwd.Args, clientID)
+	fwd.Args = append(fwd.Args, resp.CmdName)
+	fwd.Args = append(fwd.Args, resp.Args...)
+	
+	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC] != nil {
+		err := self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC].Channel.Broadcast(link.JSON {
+			fwd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)sendToTopicClient(client *TopicClient, resp *protocol.CmdSimple) error {
+	if client.Session != nil {
+		return client.Session.Send(link.JSON {
+			resp,
+		})
+	}
+	return self.sendToClient(client.ID, client.MsgServerAddr, resp)
+}
+
+// Ask the router to run the topic command on hostAddr, which holds the topic.
+func (self *ProtoProc)forwardTopicCmd(cmd protocol.Cmd, client *TopicClient, hostAddr string) error {
+	glog.Info("forwardTopicCmd")
+	fwd := protocol.NewCmdSimple()
+	fwd.CmdName = protocol.FORWARD_TOPIC_CMD
+	fwd.Args = append(fwd.Args, hostAddr)
+	fwd.Args = append(fwd.Args, client.ID)
+	fwd.Args = append(fwd.Args, client.MsgServerAddr)
+	fwd.Args = append(fwd.Args, cmd.GetCmdName())
+	fwd.Args = append(fwd.Args, cmd.GetArgs()...)
+	
+	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC] != nil {
+		err := self.msgServer.channels[protocol.SYSCTRL_TOPIC_SYNC].Channel.Broadcast(link.JSON {
+			fwd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+// The responses of the topic commands that run on the msg_server holding the topic.
+var hostTopicResp = map[string]string {
+	protocol.JOIN_TOPIC_CMD     : protocol.RESP_JOIN_TOPIC_CMD,
+	protocol.LEAVE_TOPIC_CMD    : protocol.RESP_LEAVE_TOPIC_CMD,
+	protocol.DELETE_TOPIC_CMD   : protocol.RESP_DELETE_TOPIC_CMD,
+	protocol.SET_TOPIC_ROLE_CMD : protocol.RESP_SET_TOPIC_ROLE_CMD,
+	protocol.SET_TOPIC_MODE_CMD : protocol.RESP_SET_TOPIC_MODE_CMD,
+	protocol.APPROVE_MEMBER_CMD : protocol.RESP_APPROVE_MEMBER_CMD,
+	protocol.KICK_MEMBER_CMD    : protocol.RESP_KICK_MEMBER_CMD,
+	protocol.BAN_MEMBER_CMD     : protocol.RESP_BAN_MEMBER_CMD,
+	protocol.UNBAN_MEMBER_CMD   : protocol.RESP_UNBAN_MEMBER_CMD,
+}
+
+// Run a topic command here if this msg_server holds the topic, otherwise
+// forward it through the router to the one that does.
+func (self *ProtoProc)procHostTopicCmd(cmd protocol.Cmd, client *TopicClient) error {
+	glog.Info("procHostTopicCmd")
+	if len(cmd.GetArgs()) < 1 {
+		return BADARGS
+	}
+	topicName := cmd.GetArgs()[0]
+	
+	self.msgServer.topicMutex.Lock()
+	t := self.msgServer.topics[topicName]
+	if t == nil {
+		self.msgServer.topicMutex.Unlock()
+		tsd, err := self.findTopicMsgAddr(topicName)
+		// a routed command must not be routed again
+		if err != nil || client.Session == nil || tsd.MsgServerAddr == self.msgServer.cfg.LocalIP {
+			glog.Warning("no topic :" + topicName)
+			return self.sendTopicResult(hostTopicResp[cmd.GetCmdName()], topicName, NOTOPIC, client)
+		}
+		return self.forwardTopicCmd(cmd, client, tsd.MsgServerAddr)
+	}
+	// the commands of the local topics run one at a time, whichever
+	// client or peer session they come from
+	defer self.msgServer.topicMutex.Unlock()
+	
+	switch cmd.GetCmdName() {
+		case protocol.JOIN_TOPIC_CMD:
+			return self.procJoinTopic(cmd, t, client)
+		case protocol.LEAVE_TOPIC_CMD:
+			return self.procLeaveTopic(cmd, t, client)
+		case protocol.DELETE_TOPIC_CMD:
+			return self.procDeleteTopic(cmd, t, client)
+		case protocol.SET_TOPIC_ROLE_CMD:
+			return self.procSetTopicRole(cmd, t, client)
+		case protocol.SET_TOPIC_MODE_CMD:
+			return self.procSetTopicMode(cmd, t, client)
+		case protocol.APPROVE_MEMBER_CMD:
+			return self.procApproveMember(cmd, t, client)
+		case protocol.KICK_MEMBER_CMD:
+			return self.procKickMember(cmd, t, client)
+		case protocol.BAN_MEMBER_CMD:
+			return self.procBanMember(cmd, t, client)
+		case protocol.UNBAN_MEMBER_CMD:
+			return self.procUnbanMember(cmd, t, client)
+	}
+	
+	return nil
+}
+
+// A topic command routed from the msg_server the client is connected to.
+func (self *ProtoProc)procRouteTopicCmd(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procRouteTopicCmd")
+	if len(cmd.GetArgs()) < 3 {
+		return BADARGS
+	}
+	client := &TopicClient {
+		ID            : cmd.GetArgs()[0],
+		MsgServerAddr : cmd.GetArgs()[1],
+	}
+	
+	topicCmd := protocol.NewCmdSimple()
+	topicCmd.CmdName = cmd.GetArgs()[2]
+	topicCmd.Args = append(topicCmd.Args, cmd.GetArgs()[3:]...)
+	
+	return self.procHostTopicCmd(topicCmd, client)
+}
+
+// A reply of the msg_server holding a topic to a client connected here.
+func (self *ProtoProc)procRouteTopicReply(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procRouteTopicReply")
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = cmd.GetArgs()[1]
+	resp.Args = append(resp.Args, cmd.GetArgs()[2:]...)
+	
+	return self.sendToClient(cmd.GetArgs()[0], self.msgServer.cfg.LocalIP, resp)
+}
+
+// Join the topics of a client which has just connected here again, so
+// that the topics know which msg_server it is on now.
+func (self *ProtoProc)rejoinTopics(session *link.Session) {
+	client := self.localTopicClient(session)
+	topicNames, err := self.msgServer.topicStore.GetClientTopics(client.ID)
+	if err != nil {
+		glog.Error(err.Error())
+		return
+	}
+	
+	for _, topicName := range topicNames {
+		cmd := protocol.NewCmdSimple()
+		cmd.CmdName = protocol.JOIN_TOPIC_CMD
+		cmd.Args = append(cmd.Args, topicName)
+		err = self.procHostTopicCmd(cmd, client)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+}
+
+func (self *ProtoProc)sendTopicStatus(cmdName string, topicName string, status string, client *TopicClient) error {
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = cmdName
+	resp.Args = append(resp.Args, topicName)
+	resp.Args = append(resp.Args, status)
+	
+	err := self.sendToTopicClient(client, resp)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)sendTopicResult(cmdName string, topicName string, result error, client *TopicClient) error {
+	if result == nil {
+		return self.sendTopicStatus(cmdName, topicName, protocol.RESULT_OK, client)
+	}
+	err := self.sendTopicStatus(cmdName, topicName, result.Error(), client)
+	if err != nil {
+		return err
+	}
+	
+	return result
+}
+
+func (self *ProtoProc)findTopicMsgAddr(topicName string) (*storage.TopicStoreData, error) {
+	glog.Info("findTopicMsgAddr")
+	t, err := common.GetTopicFromTopicName(self.msgServer.topicStore, topicName)
+	
+	return t, err
+}
+
+func (self *ProtoProc)addTopicMember(t *protocol.Topic, client *TopicClient) error {
+	if client.Session != nil {
+		t.Channel.Join(client.Session, nil)
+	}
+	m := storage.NewMember(client.ID)
+	m.MsgServerAddr = client.MsgServerAddr
+	t.ClientIDList = append(t.ClientIDList, client.ID)
+	t.AddMember(m)
+	
+	return self.storeTopicMember(protocol.STORE_TOPIC_MEMBER_CMD, t.TopicName, m)
+}
+
+// Remove the member from the topic and tell it why.
+func (self *ProtoProc)kickTopicMember(t *protocol.Topic, clientID string, reason string) {
+	m := t.TSD.GetMember(clientID)
+	if m == nil {
+		return
+	}
+	t.RemoveMember(clientID)
+	if m.MsgServerAddr == "" || m.MsgServerAddr == self.msgServer.cfg.LocalIP {
+		if s := self.msgServer.getSession(clientID); s != nil {
+			t.Channel.Exit(s)
+		}
+	}
+	err := self.storeTopicMember(protocol.DELETE_TOPIC_MEMBER_CMD, t.TopicName, m)
+	if err != nil {
+		glog.Error(err.Error())
+	}
+	
+	notice := protocol.NewCmdSimple()
+	notice.CmdName = protocol.TOPIC_KICKED_CMD
+	notice.Args = append(notice.Args, t.TopicName)
+	notice.Args = append(notice.Args, reason)
+	err = self.sendToClient(clientID, m.MsgServerAddr, notice)
+	if err != nil {
+		glog.Error(err.Error())
+	}
+}
+
+// Tell the admins that clientID asks to join an invite-only topic.
+func (self *ProtoProc)notifyTopicAdmins(t *protocol.Topic, clientID string) {
+	notice := protocol.NewCmdSimple()
+	notice.CmdName = protocol.TOPIC_JOIN_REQUEST_CMD
+	notice.Args = append(notice.Args, t.TopicName)
+	notice.Args = append(notice.Args, clientID)
+	
+	for _, m := range t.TSD.MemberList {
+		if t.TSD.IsAdmin(m.ID) {
+			err := self.sendToClient(m.ID, m.MsgServerAddr, notice)
+			if err != nil {
+				glog.Error(err.Error())
+			}
+		}
+	}
+}
+
+func (self *ProtoProc)procJoinTopic(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procJoinTopic")
+	topicName := t.TopicName
+	
+	if m := t.TSD.GetMember(client.ID); m != nil {
+		// the member may have moved to another msg_server
+		if client.Session != nil {
+			t.Channel.Join(client.Session, nil)
+		}
+		if m.MsgServerAddr != client.MsgServerAddr {
+			m.MsgServerAddr = client.MsgServerAddr
+			err := self.storeTopicMember(protocol.STORE_TOPIC_MEMBER_CMD, topicName, m)
+			if err != nil {
+				return err
+			}
+		}
+		return self.sendTopicResult(protocol.RESP_JOIN_TOPIC_CMD, topicName, nil, client)
+	}
+	if t.TSD.IsBanned(client.ID) {
+		return self.sendTopicResult(protocol.RESP_JOIN_TOPIC_CMD, topicName, BANNED, client)
+	}
+	if t.TSD.Mode == storage.TOPIC_MODE_INVITE && !t.TSD.IsInvited(client.ID) {
+		t.TSD.AddPending(client.ID)
+		self.notifyTopicAdmins(t, client.ID)
+		err := self.storeTopic(t)
+		if err != nil {
+			return err
+		}
+		return self.sendTopicStatus(protocol.RESP_JOIN_TOPIC_CMD, topicName, protocol.RESULT_PENDING, client)
+	}
+	t.TSD.RemoveInvite(client.ID)
+	err := self.addTopicMember(t, client)
+	if err != nil {
+		return err
+	}
+	err = self.storeTopic(t)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_JOIN_TOPIC_CMD, topicName, nil, client)
+}
+
+func (self *ProtoProc)procLeaveTopic(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procLeaveTopic")
+	topicName := t.TopicName
+	
+	m := t.TSD.GetMember(client.ID)
+	if m == nil {
+		return self.sendTopicResult(protocol.RESP_LEAVE_TOPIC_CMD, topicName, NOTMEMBER, client)
+	}
+	if client.Session != nil {
+		t.Channel.Exit(client.Session)
+	}
+	t.RemoveMember(client.ID)
+	
+	err := self.storeTopicMember(protocol.DELETE_TOPIC_MEMBER_CMD, topicName, m)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_LEAVE_TOPIC_CMD, topicName, nil, client)
+}
+
+func (self *ProtoProc)procDeleteTopic(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procDeleteTopic")
+	var err error
+	topicName := t.TopicName
+	
+	if t.TA.CreaterID != client.ID {
+		return self.sendTopicResult(protocol.RESP_DELETE_TOPIC_CMD, topicName, NOTCREATER, client)
+	}
+	
+	notice := protocol.NewCmdSimple()
+	notice.CmdName = protocol.TOPIC_DELETED_CMD
+	notice.Args = append(notice.Args, topicName)
+	for _, m := range t.TSD.MemberList {
+		err = self.sendToClient(m.ID, m.MsgServerAddr, notice)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+	self.exitTopicChannel(t)
+	delete(self.msgServer.topics, topicName)
+	
+	args := make([]string, 0)
+	args = append(args, topicName)
+	CCmd := protocol.NewCmdInternal(protocol.DELETE_TOPIC_CMD, args, t.TSD)
+	
+	if self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS] != nil {
+		err = self.msgServer.channels[protocol.SYSCTRL_TOPIC_STATUS].Channel.Broadcast(link.JSON {
+			CCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	err = self.syncTopic(protocol.DELETE_TOPIC_CMD, topicName)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_DELETE_TOPIC_CMD, topicName, nil, client)
+}
+
+// Take the local sessions of every member of t out of its channel, so that
+// nothing is left joined to a topic which is gone.
+func (self *ProtoProc)exitTopicChannel(t *protocol.Topic) {
+	for _, m := range t.TSD.MemberList {
+		for _, s := range self.msgServer.clientSessions(m.ID) {
+			t.Channel.Exit(s)
+		}
+	}
+	t.ClientIDList = t.ClientIDList[:0]
+}
+
+func (self *ProtoProc)procListTopicMembers(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procListTopicMembers")
+	var err error
+	if len(cmd.GetArgs()) < 1 {
+		return BADARGS
+	}
+	topicName := cmd.GetArgs()[0]
+	client := self.localTopicClient(session)
+	
+	// only the members may see who else is in the topic
+	var members []*storage.Member
+	isMember := false
+	self.msgServer.topicMutex.Lock()
+	t := self.msgServer.topics[topicName]
+	if t != nil {
+		members = append(members, t.TSD.MemberList...)
+		isMember = t.HasMember(client.ID)
+	}
+	self.msgServer.topicMutex.Unlock()
+	if t == nil {
+		_, err = self.findTopicMsgAddr(topicName)
+		if err != nil {
+			return self.sendTopicResult(protocol.RESP_LIST_TOPIC_MEMBERS_CMD, topicName, NOTOPIC, client)
+		}
+		isMember, err = self.msgServer.topicStore.IsMember(topicName, client.ID)
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+		if isMember {
+			members, err = common.GetTopicMembers(self.msgServer.topicStore, topicName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !isMember {
+		return self.sendTopicResult(protocol.RESP_LIST_TOPIC_MEMBERS_CMD, topicName, NOTMEMBER, client)
+	}
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_LIST_TOPIC_MEMBERS_CMD
+	resp.Args = append(resp.Args, topicName)
+	resp.Args = append(resp.Args, protocol.RESULT_OK)
+	for _, m := range members {
+		resp.Args = append(resp.Args, m.ID)
+	}
+	
+	err = session.Send(link.JSON {
+		resp,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procListMyTopics(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procListMyTopics")
+	clientID := session.State.(*base.SessionState).ClientID
+	
+	topicNames, err := self.msgServer.topicStore.GetClientTopics(clientID)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	resp := protocol.NewCmdSimple()
+	resp.CmdName = protocol.RESP_LIST_MY_TOPICS_CMD
+	resp.Args = append(resp.Args, topicNames...)
+	
+	err = session.Send(link.JSON {
+		resp,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procSetTopicRole(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procSetTopicRole")
+	topicName := t.TopicName
+	if len(cmd.GetArgs()) < 3 {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_ROLE_CMD, topicName, BADARGS, client)
+	}
+	memberID := cmd.GetArgs()[1]
+	role := cmd.GetArgs()[2]
+	
+	if !t.TSD.IsAdmin(client.ID) {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_ROLE_CMD, topicName, NOTADMIN, client)
+	}
+	if !storage.IsTopicRole(role) || role == storage.TOPIC_ROLE_OWNER {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_ROLE_CMD, topicName, BADROLE, client)
+	}
+	m := t.TSD.GetMember(memberID)
+	if m == nil {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_ROLE_CMD, topicName, NOTMEMBER, client)
+	}
+	// only the owner can promote or demote admins, and nobody can change the owner
+	if memberID == t.TSD.CreaterID {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_ROLE_CMD, topicName, NOTCREATER, client)
+	}
+	if (role == storage.TOPIC_ROLE_ADMIN || t.TSD.IsAdmin(memberID)) && client.ID != t.TSD.CreaterID {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_ROLE_CMD, topicName, NOTCREATER, client)
+	}
+	m.Role = role
+	
+	err := self.storeTopicMember(protocol.STORE_TOPIC_MEMBER_CMD, topicName, m)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_SET_TOPIC_ROLE_CMD, topicName, nil, client)
+}
+
+func (self *ProtoProc)procSetTopicMode(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procSetTopicMode")
+	topicName := t.TopicName
+	if len(cmd.GetArgs()) < 2 {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_MODE_CMD, topicName, BADARGS, client)
+	}
+	mode := cmd.GetArgs()[1]
+	
+	if !t.TSD.IsAdmin(client.ID) {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_MODE_CMD, topicName, NOTADMIN, client)
+	}
+	if !storage.IsTopicMode(mode) {
+		return self.sendTopicResult(protocol.RESP_SET_TOPIC_MODE_CMD, topicName, BADMODE, client)
+	}
+	t.TSD.Mode = mode
+	
+	err := self.storeTopic(t)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_SET_TOPIC_MODE_CMD, topicName, nil, client)
+}
+
+func (self *ProtoProc)procApproveMember(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procApproveMember")
+	var err error
+	topicName := t.TopicName
+	if len(cmd.GetArgs()) < 2 {
+		return self.sendTopicResult(protocol.RESP_APPROVE_MEMBER_CMD, topicName, BADARGS, client)
+	}
+	memberID := cmd.GetArgs()[1]
+	
+	if !t.TSD.IsAdmin(client.ID) {
+		return self.sendTopicResult(protocol.RESP_APPROVE_MEMBER_CMD, topicName, NOTADMIN, client)
+	}
+	if t.TSD.IsBanned(memberID) {
+		return self.sendTopicResult(protocol.RESP_APPROVE_MEMBER_CMD, topicName, BANNED, client)
+	}
+	if t.HasMember(memberID) {
+		return self.sendTopicResult(protocol.RESP_APPROVE_MEMBER_CMD, topicName, nil, client)
+	}
+	
+	// a pending member that is online joins at once, anybody else may join later
+	member, err := self.findTopicClient(memberID)
+	if t.TSD.IsPending(memberID) && err == nil {
+		t.TSD.RemovePending(memberID)
+		err = self.addTopicMember(t, member)
+		if err != nil {
+			return err
+		}
+		err = self.sendTopicResult(protocol.RESP_JOIN_TOPIC_CMD, topicName, nil, member)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	} else {
+		t.TSD.RemovePending(memberID)
+		t.TSD.Invite(memberID)
+	}
+	
+	err = self.storeTopic(t)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_APPROVE_MEMBER_CMD, topicName, nil, client)
+}
+
+// Admins may kick or ban publishers and subscribers, only the owner may
+// kick or ban admins.
+func (self *ProtoProc)canModerate(t *protocol.Topic, clientID string, memberID string) error {
+	if !t.TSD.IsAdmin(clientID) {
+		return NOTADMIN
+	}
+	if memberID == t.TSD.CreaterID {
+		return NOTCREATER
+	}
+	if t.TSD.IsAdmin(memberID) && clientID != t.TSD.CreaterID {
+		return NOTCREATER
+	}
+	return nil
+}
+
+func (self *ProtoProc)procKickMember(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procKickMember")
+	topicName := t.TopicName
+	if len(cmd.GetArgs()) < 2 {
+		return self.sendTopicResult(protocol.RESP_KICK_MEMBER_CMD, topicName, BADARGS, client)
+	}
+	memberID := cmd.GetArgs()[1]
+	
+	err := self.canModerate(t, client.ID, memberID)
+	if err != nil {
+		return self.sendTopicResult(protocol.RESP_KICK_MEMBER_CMD, topicName, err, client)
+	}
+	if !t.HasMember(memberID) {
+		return self.sendTopicResult(protocol.RESP_KICK_MEMBER_CMD, topicName, NOTMEMBER, client)
+	}
+	self.kickTopicMember(t, memberID, protocol.KICK_MEMBER_CMD)
+	
+	err = self.storeTopic(t)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_KICK_MEMBER_CMD, topicName, nil, client)
+}
+
+func (self *ProtoProc)procBanMember(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procBanMember")
+	topicName := t.TopicName
+	if len(cmd.GetArgs()) < 2 {
+		return self.sendTopicResult(protocol.RESP_BAN_MEMBER_CMD, topicName, BADARGS, client)
+	}
+	memberID := cmd.GetArgs()[1]
+	
+	err := self.canModerate(t, client.ID, memberID)
+	if err != nil {
+		return self.sendTopicResult(protocol.RESP_BAN_MEMBER_CMD, topicName, err, client)
+	}
+	if t.HasMember(memberID) {
+		self.kickTopicMember(t, memberID, protocol.BAN_MEMBER_CMD)
+	}
+	t.TSD.Ban(memberID)
+	
+	err = self.storeTopic(t)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_BAN_MEMBER_CMD, topicName, nil, client)
+}
+
+func (self *ProtoProc)procUnbanMember(cmd protocol.Cmd, t *protocol.Topic, client *TopicClient) error {
+	glog.Info("procUnbanMember")
+	topicName := t.TopicName
+	if len(cmd.GetArgs()) < 2 {
+		return self.sendTopicResult(protocol.RESP_UNBAN_MEMBER_CMD, topicName, BADARGS, client)
+	}
+	memberID := cmd.GetArgs()[1]
+	
+	if !t.TSD.IsAdmin(client.ID) {
+		return self.sendTopicResult(protocol.RESP_UNBAN_MEMBER_CMD, topicName, NOTADMIN, client)
+	}
+	t.TSD.Unban(memberID)
+	
+	err := self.storeTopic(t)
+	if err != nil {
+		return err
+	}
+	
+	return self.sendTopicResult(protocol.RESP_UNBAN_MEMBER_CMD, topicName, nil, client)
+}
+
+func (self *ProtoProc)procTakeoverTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procTakeoverTopic")
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	
+	return self.takeoverTopic(cmd.GetArgs()[0], cmd.GetArgs()[1])
+}
+
+// Take over a topic held by the dead msg_server deadAddr, which may be this
+// one before a restart. The manager has moved the topic to this msg_server
+// in the topic store already. The topic is rebuilt from the topic store and
+// its members are told where it is now.
+func (self *ProtoProc)takeoverTopic(topicName string, deadAddr string) error {
+	var err error
+	self.msgServer.topicMutex.Lock()
+	defer self.msgServer.topicMutex.Unlock()
+	if self.msgServer.topics[topicName] != nil {
+		return nil
+	}
+	tsd, err := self.findTopicMsgAddr(topicName)
+	if err != nil {
+		return err
+	}
+	if tsd.MsgServerAddr != self.msgServer.cfg.LocalIP {
+		glog.Infof("topic %s is held by %s", topicName, tsd.MsgServerAddr)
+		return nil
+	}
+	tsd.MemberList, err = common.GetTopicMembers(self.msgServer.topicStore, topicName)
+	if err != nil {
+		return err
+	}
+	
+	tsd.MsgServerAddr = self.msgServer.cfg.LocalIP
+	t := protocol.NewTopic(topicName, self.msgServer.cfg.LocalIP, tsd.CreaterID, nil)
+	t.Channel = link.NewChannel(self.msgServer.server.Protocol())
+	t.TSD = tsd
+	for _, m := range tsd.MemberList {
+		t.ClientIDList = append(t.ClientIDList, m.ID)
+		// members of the dead msg_server are found by their sessions again
+		if m.MsgServerAddr == deadAddr {
+			m.MsgServerAddr = ""
+			err = self.storeTopicMember(protocol.STORE_TOPIC_MEMBER_CMD, topicName, m)
+			if err != nil {
+				glog.Error(err.Error())
+			}
+		}
+		if s := self.msgServer.getSession(m.ID); m.MsgServerAddr == self.msgServer.cfg.LocalIP && s != nil {
+			t.Channel.Join(s, nil)
+		}
+	}
+	self.msgServer.topics[topicName] = t
+	
+	err = self.storeTopic(t)
+	if err != nil {
+		return err
+	}
+	err = self.syncTopic(protocol.CREATE_TOPIC_CMD, topicName)
+	if err != nil {
+		return err
+	}
+	
+	notice := protocol.NewCmdSimple()
+	notice.CmdName = protocol.TOPIC_MOVED_CMD
+	notice.Args = append(notice.Args, topicName)
+	notice.Args = append(notice.Args, self.msgServer.cfg.LocalIP)
+	for _, m := range tsd.MemberList {
+		err = self.sendToClient(m.ID, m.MsgServerAddr, notice)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+	
+	return nil
+}
+
+// Drop the local topics which the topic store says another msg_server holds,
+// as it took them over while this one was away. With no args every local
+// topic is checked. The local members are told where the topic is now.
+func (self *ProtoProc)procDropTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procDropTopic")
+	self.msgServer.topicMutex.Lock()
+	defer self.msgServer.topicMutex.Unlock()
+	topicNames := cmd.GetArgs()
+	if len(topicNames) == 0 {
+		for topicName := range self.msgServer.topics {
+			topicNames = append(topicNames, topicName)
+		}
+	}
+	
+	for _, topicName := range topicNames {
+		t := self.msgServer.topics[topicName]
+		if t == nil {
+			continue
+		}
+		tsd, err := self.msgServer.topicStore.Get(topicName)
+		if err != nil {
+			// a topic which is not in the store is nobody else's
+			if err != storage.ErrNotFound {
+				glog.Error(err.Error())
+			}
+			continue
+		}
+		if tsd.MsgServerAddr == self.msgServer.cfg.LocalIP {
+			continue
+		}
+		glog.Warningf("topic %s is held by %s now, drop it", topicName, tsd.MsgServerAddr)
+		
+		notice := protocol.NewCmdSimple()
+		notice.CmdName = protocol.TOPIC_MOVED_CMD
+		notice.Args = append(notice.Args, topicName)
+		notice.Args = append(notice.Args, tsd.MsgServerAddr)
+		for _, m := range t.TSD.MemberList {
+			for _, s := range self.msgServer.clientSessions(m.ID) {
+				t.Channel.Exit(s)
+				err = s.Send(link.JSON {
+					notice,
+				})
+				if err != nil {
+					glog.Error(err.Error())
+				}
+			}
+		}
+		delete(self.msgServer.topics, topicName)
+	}
+	
+	return nil
+}
+
+// Get the presence of id. A client whose msg_server has left the registry
+// is offline.
+func (self *ProtoProc)getPresence(id string) *storage.PresenceData {
+	p, err := self.msgServer.presenceStore.Get(id)
+	if err != nil {
+		return storage.NewPresenceData(id, protocol.PRESENCE_OFFLINE, "", "")
+	}
+	if p.State != protocol.PRESENCE_OFFLINE && p.MsgServerAddr != self.msgServer.cfg.LocalIP {
+		_, err = self.msgServer.msgServerStore.Get(p.MsgServerAddr)
+		if err != nil {
+			p.State = protocol.PRESENCE_OFFLINE
+		}
+	}
+	return p
+}
+
+// Save the presence of clientID and notify its subscribers if it changed.
+// Only the msg_server the client last logged in may set it offline.
+func (self *ProtoProc)setPresence(clientID string, state string, status string) error {
+	glog.Info("setPresence")
+	old, err := self.msgServer.presenceStore.Get(clientID)
+	if err == nil {
+		// the record must still move to this msg_server after a re-login here
+		if old.State == state && old.Status == status && old.MsgServerAddr == self.msgServer.cfg.LocalIP {
+			return nil
+		}
+		if state == protocol.PRESENCE_OFFLINE && old.MsgServerAddr != self.msgServer.cfg.LocalIP {
+			return nil
+		}
+	}
+	
+	p := storage.NewPresenceData(clientID, state, status, self.msgServer.cfg.LocalIP)
+	err = self.msgServer.presenceStore.Set(p)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return self.notifyPresence(p)
+}
+
+func (self *ProtoProc)newPresenceNotify(p *storage.PresenceData) *protocol.CmdSimple {
+	notice := protocol.NewCmdSimple()
+	notice.CmdName = protocol.PRESENCE_NOTIFY_CMD
+	notice.Args = append(notice.Args, p.ClientID)
+	notice.Args = append(notice.Args, p.State)
+	notice.Args = append(notice.Args, p.Status)
+	return notice
+}
+
+// Push the presence to every subscriber, wherever it is connected.
+func (self *ProtoProc)notifyPresence(p *storage.PresenceData) error {
+	subscribers, err := self.msgServer.presenceStore.GetSubscribers(p.ClientID)
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	notice := self.newPresenceNotify(p)
+	for _, id := range subscribers {
+		if self.msgServer.getSession(id) == nil {
+			store_session, err := common.GetSessionFromCID(self.msgServer.sessionStore, id)
+			if err != nil {
+				continue
+			}
+			err = self.sendToClient(id, store_session.MsgServerAddr, notice)
+			if err != nil {
+				glog.Error(err.Error())
+			}
+			continue
+		}
+		err = self.sendToClient(id, self.msgServer.cfg.LocalIP, notice)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+	
+	return nil
+}
+
+// Whether the two clients are members of a common topic.
+func (self *ProtoProc)shareTopic(id string, otherID string) (bool, error) {
+	topicNames, err := self.msgServer.topicStore.GetClientTopics(id)
+	if err != nil {
+		return false, err
+	}
+	for _, topicName := range topicNames {
+		ok, err := self.msgServer.topicStore.IsMember(topicName, otherID)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// A client may only watch the presence of itself and of the clients it
+// shares a topic with. Other ids are skipped.
+func (self *ProtoProc)procSubscribePresence(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procSubscribePresence")
+	clientID := session.State.(*base.SessionState).ClientID
+	
+	for _, id := range cmd.GetArgs() {
+		if id != clientID {
+			ok, err := self.shareTopic(clientID, id)
+			if err != nil {
+				glog.Error(err.Error())
+				return err
+			}
+			if !ok {
+				glog.Warningf("%s can not watch the presence of %s", clientID, id)
+				continue
+			}
+		}
+		err := self.msgServer.presenceStore.AddSubscriber(id, clientID)
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+		err = session.Send(link.JSON {
+			self.newPresenceNotify(self.getPresence(id)),
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procUnsubscribePresence(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procUnsubscribePresence")
+	clientID := session.State.(*base.SessionState).ClientID
+	
+	for _, id := range cmd.GetArgs() {
+		err := self.msgServer.presenceStore.RemoveSubscriber(id, clientID)
+		if err != nil {
+			glog.Error(err.Error())
+			return err
+		}
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procSetPresence(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procSetPresence")
+	if len(cmd.GetArgs()) < 1 {
+		return BADARGS
+	}
+	state := cmd.GetArgs()[0]
+	status := ""
+	if len(cmd.GetArgs()) > 1 {
+		status = cmd.GetArgs()[1]
+	}
+	
+	switch state {
+		case protocol.PRESENCE_ONLINE, protocol.PRESENCE_AWAY, protocol.PRESENCE_OFFLINE:
+		default:
+			return BADPRESENCE
+	}
+	
+	return self.setPresence(session.State.(*base.SessionState).ClientID, state, status)
+}
@@ -16,9 +16,13 @@
 package main
 
 import (
+	"fmt"
 	"time"
 	"flag"
 	"sync"
+	"strconv"
+	"net/http"
+	"sync/atomic"
 	"encoding/json"
 	"github.com/golang/glog"
 	"github.com/funny/link"
@@ -36,39 +40,55 @@ func init() {
 type MsgServer struct {
 	cfg               *MsgServerConfig
 	sessions          base.SessionMap
+	devices           base.DeviceMap
 	channels          base.ChannelMap
 	topics            protocol.TopicMap
 	server            *link.Server
-	sessionStore      *storage.SessionStore
-	topicStore        *storage.TopicStore
-	scanSessionMutex  sync.Mutex
+	wsServer          *link.Server
+	internalServer    *link.Server
+	sessionStore      storage.SessionStore
+	topicStore        storage.TopicStore
+	offlineMsgStore   *storage.OfflineMsgStore
+	msgServerStore    *storage.MsgServerStore
+	presenceStore     *storage.PresenceStore
+	sessionMutex      sync.Mutex
+	topicMutex        sync.Mutex
+	pendingMsgs       base.PendingMsgMap
+	pendingMsgMutex   sync.Mutex
+	startTime         int64
+	msgIDSeq          uint64
 }
 
 func NewMsgServer(cfg *MsgServerConfig) *MsgServer {
+	rs := storage.NewRedisStore(&storage.RedisStoreOptions {
+		Network        : "tcp",
+		Address        : cfg.Redis.Port,
+		ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
+		ReadTimeout    : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
+		WriteTimeout   : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
+		Database       : 1,
+		KeyPrefix      : "push",
+		MaxIdle        : cfg.Redis.MaxIdle,
+		MaxActive      : cfg.Redis.MaxActive,
+		IdleTimeout    : cfg.Redis.IdleTimeout*time.Second,
+	})
+	backend := &storage.BackendOptions {
+		Redis : rs,
+	}
 	return &MsgServer {
 		cfg                : cfg,
 		sessions           : make(base.SessionMap),
+		devices            : make(base.DeviceMap),
 		channels           : make(base.ChannelMap),
 		topics             : make(protocol.TopicMap),
+		pendingMsgs        : make(base.PendingMsgMap),
+		startTime          : time.Now().Unix(),
 		server             : new(link.Server),
-		sessionStore       : storage.NewSessionStore(storage.NewRedisStore(&storage.RedisStoreOptions{
-			Network        : "tcp",
-			Address        : cfg.Redis.Port,
-			ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
-			ReadTimeout    : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
-			WriteTimeout   : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
-			Database       : 1,
-			KeyPrefix      : "push",
-		})),
-		topicStore         : storage.NewTopicStore(storage.NewRedisStore(&storage.RedisStoreOptions {
-			Network        : "tcp",
-			Address        : cfg.Redis.Port,
-			ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
-			ReadTimeout    : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
-			WriteTimeout   : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
-			Database       : 1,
-			KeyPrefix      : "push",
-		})),
+		sessionStore       : storage.NewSessionStore(backend),
+		topicStore         : storage.NewTopicStore(backend),
+		offlineMsgStore    : storage.NewOfflineMsgStore(rs),
+		msgServerStore     : storage.NewMsgServerStore(rs),
+		presenceStore      : storage.NewPresenceStore(rs),
 	}
 }
 
@@ -81,41 +101,293 @@ func (self *MsgServer)createChannels() {
 	}
 }
 
+// Close the client sessions that have not pinged since the last scan. The
+// sessions are cleaned up by removeSession.
 func (self *MsgServer)scanDeadSession() {
 	glog.Info("scanDeadSession")
 	timer := time.NewTicker(self.cfg.ScanDeadSessionTimeout * time.Second)
-	ttl := time.After(self.cfg.Expire * time.Second)
+	for {
+		<-timer.C
+		dead := make([]*link.Session, 0)
+		self.sessionMutex.Lock()
+		for _, sessions := range self.devices {
+			for _, s := range sessions {
+				state := s.State.(*base.SessionState)
+				if state.Alive == false {
+					dead = append(dead, s)
+				} else {
+					state.Alive = false
+				}
+			}
+		}
+		self.sessionMutex.Unlock()
+		
+		for _, s := range dead {
+			glog.Info("close dead session of " + s.State.(*base.SessionState).ClientID)
+			s.Close(nil)
+			self.removeSession(s)
+		}
+	}
+}
+
+// Add a logged in session of the client id. It becomes the latest session
+// of the client.
+func (self *MsgServer)addSession(id string, session *link.Session) {
+	self.sessionMutex.Lock()
+	defer self.sessionMutex.Unlock()
+	session.State = base.NewSessionState(true, id)
+	self.sessions[id] = session
+	self.devices[id] = append(self.devices[id], session)
+}
+
+// Get all the sessions of the client id on this msg_server.
+func (self *MsgServer)clientSessions(id string) []*link.Session {
+	self.sessionMutex.Lock()
+	defer self.sessionMutex.Unlock()
+	if len(self.devices[id]) == 0 && self.sessions[id] != nil {
+		return []*link.Session { self.sessions[id] }
+	}
+	return append([]*link.Session {}, self.devices[id]...)
+}
+
+// Get the latest session of the client id on this msg_server, or nil.
+func (self *MsgServer)getSession(id string) *link.Session {
+	self.sessionMutex.Lock()
+	defer self.sessionMutex.Unlock()
+	return self.sessions[id]
+}
+
+// Push the read deadline of a client session forward. Sessions of peers
+// have no deadline.
+func (self *MsgServer)setReadDeadline(session *link.Session) {
+	if self.cfg.SessionTimeout == 0 {
+		return
+	}
+	var err error
+	if _, ok := session.State.(*base.PeerState); ok {
+		err = session.Conn().SetReadDeadline(time.Time{})
+	} else {
+		err = session.Conn().SetReadDeadline(time.Now().Add(self.cfg.SessionTimeout * time.Second))
+	}
+	if err != nil {
+		glog.Error(err.Error())
+	}
+}
+
+// Check whether the client has a device on another msg_server.
+func (self *MsgServer)onlineElsewhere(id string) bool {
+	if self.cfg.LoginPolicy != LOGIN_POLICY_MULTI {
+		return false
+	}
+	store_session, err := common.GetSessionFromCID(self.sessionStore, id)
+	if err != nil {
+		return false
+	}
+	for _, addr := range store_session.MsgServerAddrs() {
+		if addr != self.cfg.LocalIP {
+			return true
+		}
+	}
+	return false
+}
+
+// Forget a closed session and remove its device from the session store.
+func (self *MsgServer)removeSession(session *link.Session) {
+	state, ok := session.State.(*base.SessionState)
+	if !ok {
+		return
+	}
+	id := state.ClientID
+	
+	self.sessionMutex.Lock()
+	found := false
+	for i, s := range self.devices[id] {
+		if s == session {
+			self.devices[id] = append(self.devices[id][:i], self.devices[id][i+1:]...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		// already removed
+		self.sessionMutex.Unlock()
+		return
+	}
+	if self.sessions[id] == session {
+		if len(self.devices[id]) > 0 {
+			self.sessions[id] = self.devices[id][len(self.devices[id]) - 1]
+		} else {
+			delete(self.sessions, id)
+		}
+	}
+	offline := false
+	if len(self.devices[id]) == 0 {
+		delete(self.devices, id)
+		offline = self.sessions[id] == nil && !self.onlineElsewhere(id)
+	}
+	self.sessionMutex.Unlock()
+	
+	if offline {
+		err := NewProtoProc(self).setPresence(id, protocol.PRESENCE_OFFLINE, "")
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+	
+	args := make([]string, 0)
+	args = append(args, id)
+	CCmd := protocol.NewCmdInternal(protocol.DELETE_DEVICE_CMD, args, 
+		storage.NewSessionStoreData(id, session.Conn().RemoteAddr().String(), self.cfg.LocalIP, 
+			strconv.FormatUint(session.Id(), 10)))
+	
+	if self.channels[protocol.SYSCTRL_CLIENT_STATUS] != nil {
+		err := self.channels[protocol.SYSCTRL_CLIENT_STATUS].Channel.Broadcast(link.JSON {
+			CCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+}
+
+// Answer the health probes of the gateways on HealthListen, so that a probe
+// never opens a client session.
+func (self *MsgServer)serveHealth() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(protocol.RESULT_OK))
+	})
+	
+	glog.Info("health check start: ", self.cfg.HealthListen)
+	err := http.ListenAndServe(self.cfg.HealthListen, mux)
+	if err != nil {
+		glog.Error(err.Error())
+	}
+}
+
+// Take back the topics this msg_server held before it restarted, as the
+// manager only fails over the msg_servers that stay away.
+func (self *MsgServer)reclaimTopics() {
+	glog.Info("reclaimTopics")
+	topicNames, err := self.topicStore.GetHostTopics(self.cfg.LocalIP)
+	if err != nil {
+		glog.Error(err.Error())
+		return
+	}
+	
+	pp := NewProtoProc(self)
+	for _, topicName := range topicNames {
+		err = pp.takeoverTopic(topicName, self.cfg.LocalIP)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+	}
+}
+
+// Register this msg_server and its load in the msg_server registry, and keep
+// the record alive until the process dies.
+func (self *MsgServer)registerMsgServer() {
+	glog.Info("registerMsgServer")
+	timer := time.NewTicker(self.cfg.RegisterInterval * time.Second)
+	for {
+		self.sessionMutex.Lock()
+		sessionNum := len(self.sessions)
+		self.sessionMutex.Unlock()
+		self.topicMutex.Lock()
+		topicNum := len(self.topics)
+		self.topicMutex.Unlock()
+		
+		ms := storage.NewMsgServerStoreData(self.cfg.LocalIP, sessionNum, topicNum, self.cfg.Weight)
+		ms.WsAddr = self.cfg.WsAddr
+		ms.HealthAddr = self.cfg.HealthAddr
+		ms.InternalAddr = self.cfg.InternalAddr
+		err := self.msgServerStore.Set(ms, self.cfg.RegisterTTL * time.Second)
+		if err != nil {
+			glog.Error(err.Error())
+		}
+		<-timer.C
+	}
+}
+
+func (self *MsgServer)newMsgID() string {
+	seq := atomic.AddUint64(&self.msgIDSeq, 1)
+	return fmt.Sprintf("%s-%d-%d", self.cfg.LocalIP, self.startTime, seq)
+}
+
+func (self *MsgServer)scanUnackedMsg() {
+	glog.Info("scanUnackedMsg")
+	timer := time.NewTicker(self.cfg.AckTimeout * time.Second)
+	pp := NewProtoProc(self)
 	for {
 		select {
 		case <-timer.C:
-			//glog.Info("scanDeadSession timeout")
-			go func() {
-				for id, s := range self.sessions {
-					self.scanSessionMutex.Lock()
-					defer self.scanSessionMutex.Unlock()
-					if (s.State).(*base.SessionState).Alive == false {
-						glog.Info("delete" + id)
-						delete(self.sessions, id)
-						err := common.DelSessionFromCID(self.sessionStore, id)
-						if err != nil {
-							glog.Warningf("delete ID : %s failed!!", id)
-						}
-					} else {
-						s.State.(*base.SessionState).Alive = false
-					}
+			offline := make([]*base.PendingMsg, 0)
+			resend := make([]*base.PendingMsg, 0)
+			self.pendingMsgMutex.Lock()
+			for id, p := range self.pendingMsgs {
+				if time.Since(p.LastSend) < self.cfg.AckTimeout * time.Second {
+					continue
 				}
-				
-			}()
-		case <-ttl:
-			break
+				if p.Retries >= self.cfg.MaxAckRetries || len(self.clientSessions(p.ToID)) == 0 {
+					delete(self.pendingMsgs, id)
+					offline = append(offline, p)
+				} else {
+					resend = append(resend, p)
+				}
+			}
+			self.pendingMsgMutex.Unlock()
+			
+			for _, p := range offline {
+				glog.Infof("msg %s to %s not acked, store offline", p.MsgID, p.ToID)
+				pp.storeOfflineMsg(p.MsgID, p.ToID, p.FromID, p.Msg)
+			}
+			for _, p := range resend {
+				glog.Infof("resend msg %s to %s", p.MsgID, p.ToID)
+				pp.resendPendingMsg(p)
+			}
 		}
 	}
 }
 
-func (self *MsgServer)parseProtocol(cmd []byte, session *link.Session) error {
+// Client commands that are only accepted after SEND_CLIENT_ID.
+func needClientID(cmdName string) bool {
+	switch cmdName {
+		case protocol.SEND_PING_CMD, protocol.SEND_MESSAGE_P2P_CMD, protocol.ACK_MESSAGE_CMD,
+			protocol.CREATE_TOPIC_CMD, protocol.JOIN_TOPIC_CMD, protocol.SEND_MESSAGE_TOPIC_CMD,
+			protocol.LEAVE_TOPIC_CMD, protocol.DELETE_TOPIC_CMD, protocol.LIST_TOPIC_MEMBERS_CMD,
+			protocol.LIST_MY_TOPICS_CMD, protocol.SET_TOPIC_ROLE_CMD, protocol.SET_TOPIC_MODE_CMD,
+			protocol.APPROVE_MEMBER_CMD, protocol.KICK_MEMBER_CMD, protocol.BAN_MEMBER_CMD,
+			protocol.UNBAN_MEMBER_CMD, protocol.SUBSCRIBE_PRESENCE_CMD, protocol.UNSUBSCRIBE_PRESENCE_CMD,
+			protocol.SET_PRESENCE_CMD:
+			return true
+	}
+	return false
+}
+
+// Commands that are only accepted from a router or manager peer.
+func needPeer(cmdName string) bool {
+	switch cmdName {
+		case protocol.ROUTE_MESSAGE_P2P_CMD, protocol.ROUTE_MESSAGE_TOPIC_CMD, 
+			protocol.ROUTE_DELIVERY_REPORT_CMD, protocol.ROUTE_MESSAGE_BROADCAST_CMD,
+			protocol.ROUTE_TOPIC_CMD, protocol.ROUTE_TOPIC_REPLY_CMD, protocol.TAKEOVER_TOPIC_CMD,
+			protocol.DROP_TOPIC_CMD, protocol.ROUTE_KICK_CLIENT_CMD:
+			return true
+	}
+	return false
+}
+
+func (self *MsgServer)parseProtocol(cmd []byte, session *link.Session) (err error) {
 	var c protocol.CmdSimple
 	
-	err := json.Unmarshal(cmd, &c)
+	// a malformed command must not bring the whole msg_server down
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("%s from %s panics : %v", c.CmdName, session.Conn().RemoteAddr().String(), r)
+			err = BADARGS
+		}
+	}()
+	
+	err = json.Unmarshal(cmd, &c)
 	if err != nil {
 		glog.Error("error:", err)
 		return err
@@ -124,12 +396,29 @@ func (self *MsgServer)parseProtocol(cmd []byte, session *link.Session) error {
 	pp := NewProtoProc(self)
 	
 	glog.Info(c.CmdName)
+	
+	if _, ok := session.State.(*base.SessionState); needClientID(c.CmdName) && !ok {
+		glog.Warning("unauthenticated client ", session.Conn().RemoteAddr().String())
+		pp.rejectSession(session, NOCLIENTID.Error())
+		return NOCLIENTID
+	}
+	if _, ok := session.State.(*base.PeerState); needPeer(c.CmdName) && !ok {
+		glog.Warning("unauthorized peer ", session.Conn().RemoteAddr().String())
+		pp.rejectSession(session, NOTAUTHPEER.Error())
+		return NOTAUTHPEER
+	}
 
 	switch c.CmdName {
 		case protocol.SEND_PING_CMD:
 			pp.procPing(c, session)
+		case protocol.PEER_NONCE_CMD:
+			pp.procPeerNonce(c, session)
 		case protocol.SUBSCRIBE_CHANNEL_CMD:
-			pp.procSubscribeChannel(c, session)
+			err = pp.procSubscribeChannel(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
 		case protocol.SEND_CLIENT_ID_CMD:
 			err = pp.procClientID(c, session)
 			if err != nil {
@@ -137,23 +426,113 @@ func (self *MsgServer)parseProtocol(cmd []byte, session *link.Session) error {
 				return err
 			}
 		case protocol.SEND_MESSAGE_P2P_CMD:
-			pp.procSendMessageP2P(c, session)
+			err = pp.procSendMessageP2P(c, session)
 			if err != nil {
 				glog.Error("error:", err)
 				return err
 			}
 		case protocol.ROUTE_MESSAGE_P2P_CMD:
-			pp.procRouteMessageP2P(c, session)
+			err = pp.procRouteMessageP2P(c, session)
 			if err != nil {
 				glog.Error("error:", err)
 				return err
 			}
 		case protocol.CREATE_TOPIC_CMD:
 			pp.procCreateTopic(c, session)
-		case protocol.JOIN_TOPIC_CMD:
-			pp.procJoinTopic(c, session)
+		case protocol.JOIN_TOPIC_CMD, protocol.LEAVE_TOPIC_CMD, protocol.DELETE_TOPIC_CMD,
+			protocol.SET_TOPIC_ROLE_CMD, protocol.SET_TOPIC_MODE_CMD, protocol.APPROVE_MEMBER_CMD,
+			protocol.KICK_MEMBER_CMD, protocol.BAN_MEMBER_CMD, protocol.UNBAN_MEMBER_CMD:
+			err = pp.procHostTopicCmd(c, pp.localTopicClient(session))
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.LIST_TOPIC_MEMBERS_CMD:
+			err = pp.procListTopicMembers(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.LIST_MY_TOPICS_CMD:
+			err = pp.procListMyTopics(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
 		case protocol.SEND_MESSAGE_TOPIC_CMD:
-			pp.procSendMessageTopic(c, session)
+			err = pp.procSendMessageTopic(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.ACK_MESSAGE_CMD:
+			err = pp.procAckMessage(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.ROUTE_DELIVERY_REPORT_CMD:
+			err = pp.procRouteDeliveryReport(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.ROUTE_MESSAGE_BROADCAST_CMD:
+			err = pp.procRouteMessageBroadcast(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.ROUTE_MESSAGE_TOPIC_CMD:
+			err = pp.procRouteMessageTopic(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.ROUTE_TOPIC_CMD:
+			err = pp.procRouteTopicCmd(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.ROUTE_TOPIC_REPLY_CMD:
+			err = pp.procRouteTopicReply(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.TAKEOVER_TOPIC_CMD:
+			err = pp.procTakeoverTopic(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.DROP_TOPIC_CMD:
+			err = pp.procDropTopic(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.SUBSCRIBE_PRESENCE_CMD:
+			err = pp.procSubscribePresence(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.UNSUBSCRIBE_PRESENCE_CMD:
+			err = pp.procUnsubscribePresence(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.SET_PRESENCE_CMD:
+			err = pp.procSetPresence(c, session)
+			if err != nil {
+				glog.Error("error:", err)
+				return err
+			}
+		case protocol.ROUTE_KICK_CLIENT_CMD:
+			err = pp.procRouteKickClient(c, session)
 			if err != nil {
 				glog.Error("error:", err)
 				return err
@@ -1,140 +1,215 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package protocol
-
-const (
-	SEND_PING_CMD               = "SEND_PING_ID"
-	SEND_CLIENT_ID_CMD          = "SEND_CLIENT_ID"
-	SUBSCRIBE_CHANNEL_CMD       = "SUBSCRIBE_CHANNEL"
-	SEND_MESSAGE_P2P_CMD        = "SEND_MESSAGE_P2P"
-	RESP_MESSAGE_P2P_CMD        = "RESP_MESSAGE_P2P"
-	ROUTE_MESSAGE_P2P_CMD       = "ROUTE_MESSAGE_P2P"
-	CREATE_TOPIC_CMD            = "CREATE_TOPIC"
-	JOIN_TOPIC_CMD              = "JOIN_TOPIC"
-	LOCATE_TOPIC_MSG_ADDR_CMD   = "LOCATE_TOPIC_MSG_ADDR"
-	SEND_MESSAGE_TOPIC_CMD      = "SEND_MESSAGE_TOPIC"
-	RESP_MESSAGE_TOPIC_CMD      = "RESP_MESSAGE_TOPIC"
-)
-
-const (
-	STORE_SESSION_CMD       = "STORE_SESSION"
-	STORE_TOPIC_CMD         = "STORE_TOPIC"
-)
-
-const (
-	PING  = "PING"
-)
-
-type Cmd interface {
-	GetCmdName() string
-	ChangeCmdName(newName string)
-	GetArgs() []string
-	AddArg(arg string)
-	ParseCmd(msglist []string)
-	GetAnyData() interface{}
-}
-
-
-type CmdSimple struct {
-	CmdName string
-	Args    []string
-}
-
-func NewCmdSimple() *CmdSimple {
-	return &CmdSimple {
-		CmdName : "",
-		Args    : make([]string, 0),
-	}
-}
-
-func (self CmdSimple)GetCmdName() string {
-	return self.CmdName
-}
-
-func (self CmdSimple)ChangeCmdName(newName string) {
-	self.CmdName = newName
-}
-
-func (self CmdSimple)GetArgs() []string {
-	return self.Args
-}
-
-func (self CmdSimple)AddArg(arg string) {
-	self.Args = append(self.Args, arg)
-}
-
-func (self CmdSimple)ParseCmd(msglist []string) {
-	self.CmdName = msglist[1]
-	self.Args = msglist[2:]
-}
-
-func (self CmdSimple)GetAnyData() interface{} {
-	return nil
-}
-
-type CmdInternal struct {
-	CmdName string
-	Args    []string
-	AnyData interface{}
-}
-
-func NewCmdInternal(cmdName string, args []string, anyData interface{}) *CmdInternal {
-	return &CmdInternal {
-		CmdName : cmdName,
-		Args    : args,
-		AnyData : anyData,
-	}
-}
-
-func (self CmdInternal)ParseCmd(msglist []string) {
-	self.CmdName = msglist[1]
-	self.Args = msglist[2:]
-}
-
-func (self CmdInternal)GetCmdName() string {
-	return self.CmdName
-}
-
-func (self CmdInternal)ChangeCmdName(newName string) {
-	self.CmdName = newName
-}
-
-func (self CmdInternal)GetArgs() []string {
-	return self.Args
-}
-
-func (self CmdInternal)AddArg(arg string) {
-	self.Args = append(self.Args, arg)
-}
-
-func (self CmdInternal)SetAnyData(a interface{}) {
-	self.AnyData = a
-}
-
-func (self CmdInternal)GetAnyData() interface{} {
-	return self.AnyData
-}
-
-type ClientIDCmd struct {
-	CmdName  string
-	ClientID string
-}
-
-type SendMessageP2PCmd struct {
-	CmdName string
-	ID      string
-	Msg     string
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+const (
+	SEND_PING_CMD               = "SEND_PING_ID"
+	RESP_PING_CMD               = "RESP_PING"
+	SEND_CLIENT_ID_CMD          = "SEND_CLIENT_ID"
+	RESP_CLIENT_ID_CMD          = "RESP_CLIENT_ID"
+	SUBSCRIBE_CHANNEL_CMD       = "SUBSCRIBE_CHANNEL"
+	PEER_NONCE_CMD              = "PEER_NONCE"
+	RESP_PEER_NONCE_CMD         = "RESP_PEER_NONCE"
+	SEND_MESSAGE_P2P_CMD        = "SEND_MESSAGE_P2P"
+	RESP_MESSAGE_P2P_CMD        = "RESP_MESSAGE_P2P"
+	ROUTE_MESSAGE_P2P_CMD       = "ROUTE_MESSAGE_P2P"
+	CREATE_TOPIC_CMD            = "CREATE_TOPIC"
+	RESP_CREATE_TOPIC_CMD       = "RESP_CREATE_TOPIC"
+	JOIN_TOPIC_CMD              = "JOIN_TOPIC"
+	LOCATE_TOPIC_MSG_ADDR_CMD   = "LOCATE_TOPIC_MSG_ADDR"
+	SEND_MESSAGE_TOPIC_CMD      = "SEND_MESSAGE_TOPIC"
+	RESP_MESSAGE_TOPIC_CMD      = "RESP_MESSAGE_TOPIC"
+	ROUTE_MESSAGE_TOPIC_CMD     = "ROUTE_MESSAGE_TOPIC"
+	ACK_MESSAGE_CMD             = "ACK_MESSAGE"
+	DELIVERY_REPORT_CMD         = "DELIVERY_REPORT"
+	ROUTE_DELIVERY_REPORT_CMD   = "ROUTE_DELIVERY_REPORT"
+	AUTH_FAILED_CMD             = "AUTH_FAILED"
+	ROUTE_MESSAGE_BROADCAST_CMD = "ROUTE_MESSAGE_BROADCAST"
+	RESP_MESSAGE_BROADCAST_CMD  = "RESP_MESSAGE_BROADCAST"
+	LEAVE_TOPIC_CMD             = "LEAVE_TOPIC"
+	RESP_LEAVE_TOPIC_CMD        = "RESP_LEAVE_TOPIC"
+	DELETE_TOPIC_CMD            = "DELETE_TOPIC"
+	RESP_DELETE_TOPIC_CMD       = "RESP_DELETE_TOPIC"
+	TOPIC_DELETED_CMD           = "TOPIC_DELETED"
+	LIST_TOPIC_MEMBERS_CMD      = "LIST_TOPIC_MEMBERS"
+	RESP_LIST_TOPIC_MEMBERS_CMD = "RESP_LIST_TOPIC_MEMBERS"
+	LIST_MY_TOPICS_CMD          = "LIST_MY_TOPICS"
+	RESP_LIST_MY_TOPICS_CMD     = "RESP_LIST_MY_TOPICS"
+	RESP_JOIN_TOPIC_CMD         = "RESP_JOIN_TOPIC"
+	TOPIC_JOIN_REQUEST_CMD      = "TOPIC_JOIN_REQUEST"
+	RESP_SEND_MESSAGE_TOPIC_CMD = "RESP_SEND_MESSAGE_TOPIC"
+	SET_TOPIC_ROLE_CMD          = "SET_TOPIC_ROLE"
+	RESP_SET_TOPIC_ROLE_CMD     = "RESP_SET_TOPIC_ROLE"
+	SET_TOPIC_MODE_CMD          = "SET_TOPIC_MODE"
+	RESP_SET_TOPIC_MODE_CMD     = "RESP_SET_TOPIC_MODE"
+	APPROVE_MEMBER_CMD          = "APPROVE_MEMBER"
+	RESP_APPROVE_MEMBER_CMD     = "RESP_APPROVE_MEMBER"
+	KICK_MEMBER_CMD             = "KICK_MEMBER"
+	RESP_KICK_MEMBER_CMD        = "RESP_KICK_MEMBER"
+	BAN_MEMBER_CMD              = "BAN_MEMBER"
+	RESP_BAN_MEMBER_CMD         = "RESP_BAN_MEMBER"
+	UNBAN_MEMBER_CMD            = "UNBAN_MEMBER"
+	RESP_UNBAN_MEMBER_CMD       = "RESP_UNBAN_MEMBER"
+	TOPIC_KICKED_CMD            = "TOPIC_KICKED"
+	FORWARD_TOPIC_CMD           = "FORWARD_TOPIC"
+	ROUTE_TOPIC_CMD             = "ROUTE_TOPIC"
+	FORWARD_TOPIC_REPLY_CMD     = "FORWARD_TOPIC_REPLY"
+	ROUTE_TOPIC_REPLY_CMD       = "ROUTE_TOPIC_REPLY"
+	TAKEOVER_TOPIC_CMD          = "TAKEOVER_TOPIC"
+	TOPIC_MOVED_CMD             = "TOPIC_MOVED"
+	DROP_TOPIC_CMD              = "DROP_TOPIC"
+	KICKED_CMD                  = "KICKED"
+	KICK_CLIENT_CMD             = "KICK_CLIENT"
+	ROUTE_KICK_CLIENT_CMD       = "ROUTE_KICK_CLIENT"
+	SUBSCRIBE_PRESENCE_CMD      = "SUBSCRIBE_PRESENCE"
+	UNSUBSCRIBE_PRESENCE_CMD    = "UNSUBSCRIBE_PRESENCE"
+	SET_PRESENCE_CMD            = "SET_PRESENCE"
+	PRESENCE_NOTIFY_CMD         = "PRESENCE_NOTIFY"
+)
+
+const (
+	STORE_SESSION_CMD       = "STORE_SESSION"
+	STORE_TOPIC_CMD         = "STORE_TOPIC"
+	STORE_DEVICE_CMD        = "STORE_DEVICE"
+	DELETE_DEVICE_CMD       = "DELETE_DEVICE"
+	STORE_TOPIC_MEMBER_CMD  = "STORE_TOPIC_MEMBER"
+	DELETE_TOPIC_MEMBER_CMD = "DELETE_TOPIC_MEMBER"
+)
+
+const (
+	PING  = "PING"
+	PONG  = "PONG"
+)
+
+const (
+	PRESENCE_ONLINE   = "online"
+	PRESENCE_AWAY     = "away"
+	PRESENCE_OFFLINE  = "offline"
+)
+
+const (
+	RESULT_OK       = "OK"
+	RESULT_PENDING  = "PENDING"
+)
+
+const (
+	DELIVERY_STATUS_SENT       = "SENT"
+	DELIVERY_STATUS_DELIVERED  = "DELIVERED"
+	DELIVERY_STATUS_OFFLINE    = "OFFLINE"
+	DELIVERY_STATUS_ROUTED     = "ROUTED"
+	DELIVERY_STATUS_FAILED     = "FAILED"
+)
+
+type Cmd interface {
+	GetCmdName() string
+	ChangeCmdName(newName string)
+	GetArgs() []string
+	AddArg(arg string)
+	ParseCmd(msglist []string)
+	GetAnyData() interface{}
+}
+
+
+type CmdSimple struct {
+	CmdName string
+	Args    []string
+}
+
+func NewCmdSimple() *CmdSimple {
+	return &CmdSimple {
+		CmdName : "",
+		Args    : make([]string, 0),
+	}
+}
+
+func (self CmdSimple)GetCmdName() string {
+	return self.CmdName
+}
+
+func (self CmdSimple)ChangeCmdName(newName string) {
+	self.CmdName = newName
+}
+
+func (self CmdSimple)GetArgs() []string {
+	return self.Args
+}
+
+func (self CmdSimple)AddArg(arg string) {
+	self.Args = append(self.Args, arg)
+}
+
+func (self CmdSimple)ParseCmd(msglist []string) {
+	self.CmdName = msglist[1]
+	self.Args = msglist[2:]
+}
+
+func (self CmdSimple)GetAnyData() interface{} {
+	return nil
+}
+
+type CmdInternal struct {
+	CmdName string
+	Args    []string
+	AnyData interface{}
+}
+
+func NewCmdInternal(cmdName string, args []string, anyData interface{}) *CmdInternal {
+	return &CmdInternal {
+		CmdName : cmdName,
+		Args    : args,
+		AnyData : anyData,
+	}
+}
+
+func (self CmdInternal)ParseCmd(msglist []string) {
+	self.CmdName = msglist[1]
+	self.Args = msglist[2:]
+}
+
+func (self CmdInternal)GetCmdName() string {
+	return self.CmdName
+}
+
+func (self CmdInternal)ChangeCmdName(newName string) {
+	self.CmdName = newName
+}
+
+func (self CmdInternal)GetArgs() []string {
+	return self.Args
+}
+
+func (self CmdInternal)AddArg(arg string) {
+	self.Args = append(self.Args, arg)
+}
+
+func (self CmdInternal)SetAnyData(a interface{}) {
+	self.AnyData = a
+}
+
+func (self CmdInternal)GetAnyData() interface{} {
+	return self.AnyData
+}
+
+type ClientIDCmd struct {
+	CmdName  string
+	ClientID string
+}
+
+type SendMessageP2PCmd struct {
+	CmdName string
+	ID      string
+	Msg     string
 }
\ No newline at end of file
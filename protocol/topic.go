@@ -1,58 +1,80 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package protocol
-
-import (
-	"github.com/funny/link"
-	"github.com/oikomi/gopush/storage"
-)
-
-type TopicMap   map[string]*Topic
-
-type Topic struct {
-	TopicName     string
-	MsgAddr       string
-	Channel       *link.Channel
-	TA            *TopicAttribute
-	ClientIDList  []string
-	TSD           *storage.TopicStoreData
-}
-
-func NewTopic(topicName string, msgAddr string, CreaterID string, CreaterSession *link.Session) *Topic {
-	return &Topic {
-		TopicName    : topicName,
-		MsgAddr      : msgAddr,
-		Channel      : new(link.Channel),
-		TA           : NewTopicAttribute(CreaterID, CreaterSession),
-		ClientIDList : make([]string, 0),
-	}
-}
-
-func (self *Topic)AddMember(m *storage.Member) {
-	self.TSD.MemberList = append(self.TSD.MemberList, m)
-}
-
-type TopicAttribute struct {
-	CreaterID          string
-	CreaterSession     *link.Session
-}
-
-func NewTopicAttribute(CreaterID string, CreaterSession *link.Session) *TopicAttribute {
-	return &TopicAttribute {
-		CreaterID      : CreaterID,
-		CreaterSession : CreaterSession,
-	}
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package protocol
+
+import (
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/storage"
+)
+
+type TopicMap   map[string]*Topic
+
+type Topic struct {
+	TopicName     string
+	MsgAddr       string
+	Channel       *link.Channel
+	TA            *TopicAttribute
+	ClientIDList  []string
+	TSD           *storage.TopicStoreData
+}
+
+func NewTopic(topicName string, msgAddr string, CreaterID string, CreaterSession *link.Session) *Topic {
+	return &Topic {
+		TopicName    : topicName,
+		MsgAddr      : msgAddr,
+		Channel      : new(link.Channel),
+		TA           : NewTopicAttribute(CreaterID, CreaterSession),
+		ClientIDList : make([]string, 0),
+	}
+}
+
+func (self *Topic)AddMember(m *storage.Member) {
+	self.TSD.MemberList = append(self.TSD.MemberList, m)
+}
+
+func (self *Topic)HasMember(id string) bool {
+	for _, cid := range self.ClientIDList {
+		if cid == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the member from both ClientIDList and TSD.MemberList.
+func (self *Topic)RemoveMember(id string) {
+	for i, cid := range self.ClientIDList {
+		if cid == id {
+			self.ClientIDList = append(self.ClientIDList[:i], self.ClientIDList[i+1:]...)
+			break
+		}
+	}
+	if self.TSD != nil {
+		self.TSD.RemoveMember(id)
+	}
+}
+
+type TopicAttribute struct {
+	CreaterID          string
+	CreaterSession     *link.Session
+}
+
+func NewTopicAttribute(CreaterID string, CreaterSession *link.Session) *TopicAttribute {
+	return &TopicAttribute {
+		CreaterID      : CreaterID,
+		CreaterSession : CreaterSession,
+	}
 }
\ No newline at end of file
@@ -0,0 +1,311 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"net/http"
+	"crypto/subtle"
+	"sync/atomic"
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/common"
+	"github.com/oikomi/gopush/protocol"
+	"github.com/oikomi/gopush/storage"
+)
+
+// The HTTP push API lets backend services push without speaking the link
+// protocol:
+//
+//   POST /push/client  {"ClientIDs" : ["id1", "id2"], "Msg" : "hello"}
+//   POST /push/topic   {"TopicName" : "topic", "Msg" : "hello"}
+//   POST /push/all     {"Msg" : "hello"}
+//
+// Every call needs the HttpApiKey in the X-Api-Key header, and answers
+// {"Results" : [{"ID" : "...", "Status" : "...", "Error" : "..."}]}.
+//
+// The listing API pages through the online clients and the topics:
+//
+//   GET /list/clients?cursor=0&count=100
+//   GET /list/topics?cursor=0&count=100
+//
+// Every call answers {"IDs" : ["..."], "Cursor" : 42}. The next page starts
+// at Cursor, and Cursor is 0 after the last page. An ID may show up twice.
+
+type PushRequest struct {
+	ClientIDs []string
+	TopicName string
+	Msg       string
+}
+
+type PushResult struct {
+	ID     string
+	Status string
+	Error  string
+}
+
+func NewPushResult(ID string, status string, err error) *PushResult {
+	r := &PushResult {
+		ID     : ID,
+		Status : status,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	return r
+}
+
+type PushResponse struct {
+	Results []*PushResult
+}
+
+// The largest page the listing API hands out.
+const MAX_LIST_COUNT = 1000
+
+type ListResponse struct {
+	IDs    []string
+	Cursor uint64
+}
+
+func (self *Router)newMsgID() string {
+	seq := atomic.AddUint64(&self.msgIDSeq, 1)
+	return fmt.Sprintf("%s-%d-%d", self.cfg.UUID, self.startTime, seq)
+}
+
+// Keep the message in the inbox of send2ID until it logs in again.
+func (self *Router)pushOffline(msgID string, send2ID string, send2Msg string) *PushResult {
+	err := self.storeOffline(msgID, send2ID, "", send2Msg)
+	if err != nil {
+		return NewPushResult(send2ID, protocol.DELIVERY_STATUS_FAILED, err)
+	}
+	return NewPushResult(send2ID, protocol.DELIVERY_STATUS_OFFLINE, nil)
+}
+
+func (self *Router)pushToClient(send2ID string, send2Msg string) *PushResult {
+	msgID := self.newMsgID()
+	store_session, err := common.GetSessionFromCID(self.sessionStore, send2ID)
+	if err != nil {
+		return self.pushOffline(msgID, send2ID, send2Msg)
+	}
+	
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.ROUTE_MESSAGE_P2P_CMD
+	routeCmd.Args = append(routeCmd.Args, send2ID)
+	routeCmd.Args = append(routeCmd.Args, send2Msg)
+	routeCmd.Args = append(routeCmd.Args, "")
+	routeCmd.Args = append(routeCmd.Args, msgID)
+	
+	// push to every device of the client, the msg_server of a device may be
+	// gone with the session not expired yet
+	routed := false
+	for _, addr := range store_session.MsgServerAddrs() {
+		msc, err := self.getMsgServerClient(addr)
+		if err != nil {
+			glog.Warningf("no link to %s : %s", addr, err.Error())
+			continue
+		}
+		err = msc.Send(link.JSON {
+			routeCmd,
+		})
+		if err != nil {
+			glog.Error(err.Error())
+			continue
+		}
+		routed = true
+	}
+	if !routed {
+		return self.pushOffline(msgID, send2ID, send2Msg)
+	}
+	
+	return NewPushResult(send2ID, protocol.DELIVERY_STATUS_ROUTED, nil)
+}
+
+func (self *Router)broadcast(send2Msg string) []*PushResult {
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.ROUTE_MESSAGE_BROADCAST_CMD
+	routeCmd.Args = append(routeCmd.Args, send2Msg)
+	routeCmd.Args = append(routeCmd.Args, "")
+	
+	self.msgServerClientMutex.RLock()
+	defer self.msgServerClientMutex.RUnlock()
+	results := make([]*PushResult, 0)
+	for ms, msc := range self.msgServerClientMap {
+		err := msc.Send(link.JSON {
+			routeCmd,
+		})
+		if err != nil {
+			results = append(results, NewPushResult(ms, protocol.DELIVERY_STATUS_FAILED, err))
+		} else {
+			results = append(results, NewPushResult(ms, protocol.DELIVERY_STATUS_ROUTED, nil))
+		}
+	}
+	
+	return results
+}
+
+func (self *Router)checkRequest(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	// an empty key never matches, so nothing is pushed or listed without one
+	key := r.Header.Get("X-Api-Key")
+	if key == "" || subtle.ConstantTimeCompare([]byte(key), []byte(self.cfg.HttpApiKey)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	
+	return true
+}
+
+func (self *Router)readPushRequest(w http.ResponseWriter, r *http.Request) (*PushRequest, bool) {
+	if !self.checkRequest(w, r, "POST") {
+		return nil, false
+	}
+	
+	var req PushRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	
+	return &req, true
+}
+
+func (self *Router)writePushResponse(w http.ResponseWriter, results []*PushResult) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(&PushResponse {
+		Results : results,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+	}
+}
+
+func (self *Router)handlePushClient(w http.ResponseWriter, r *http.Request) {
+	glog.Info("handlePushClient")
+	req, ok := self.readPushRequest(w, r)
+	if !ok {
+		return
+	}
+	
+	results := make([]*PushResult, 0)
+	for _, id := range req.ClientIDs {
+		results = append(results, self.pushToClient(id, req.Msg))
+	}
+	
+	self.writePushResponse(w, results)
+}
+
+func (self *Router)handlePushTopic(w http.ResponseWriter, r *http.Request) {
+	glog.Info("handlePushTopic")
+	req, ok := self.readPushRequest(w, r)
+	if !ok {
+		return
+	}
+	
+	results, err := self.routeTopicMsg(req.TopicName, req.Msg, "", "")
+	if err != nil {
+		http.Error(w, NOTOPIC.Error(), http.StatusNotFound)
+		return
+	}
+	
+	self.writePushResponse(w, results)
+}
+
+func (self *Router)handlePushAll(w http.ResponseWriter, r *http.Request) {
+	glog.Info("handlePushAll")
+	req, ok := self.readPushRequest(w, r)
+	if !ok {
+		return
+	}
+	
+	self.writePushResponse(w, self.broadcast(req.Msg))
+}
+
+// Answer a page of scan, from the cursor and count of the query.
+func (self *Router)writeListPage(w http.ResponseWriter, r *http.Request, scan storage.ScanFunc) {
+	if !self.checkRequest(w, r, "GET") {
+		return
+	}
+	
+	var cursor uint64
+	var err error
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		cursor, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "bad cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	count := storage.DEFAULT_SCAN_COUNT
+	if v := r.URL.Query().Get("count"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil || count <= 0 || count > MAX_LIST_COUNT {
+			http.Error(w, "bad count", http.StatusBadRequest)
+			return
+		}
+	}
+	
+	ids, next, err := scan(cursor, count)
+	if err != nil {
+		glog.Error(err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&ListResponse {
+		IDs    : ids,
+		Cursor : next,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+	}
+}
+
+func (self *Router)handleListClients(w http.ResponseWriter, r *http.Request) {
+	glog.Info("handleListClients")
+	self.writeListPage(w, r, self.sessionStore.Scan)
+}
+
+func (self *Router)handleListTopics(w http.ResponseWriter, r *http.Request) {
+	glog.Info("handleListTopics")
+	self.writeListPage(w, r, self.topicStore.Scan)
+}
+
+// Serve the HTTP API. It is not started without an HttpApiKey.
+func (self *Router)serveHttpApi() {
+	if self.cfg.HttpApiKey == "" {
+		glog.Error("http api is not started : no HttpApiKey")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/push/client", self.handlePushClient)
+	mux.HandleFunc("/push/topic", self.handlePushTopic)
+	mux.HandleFunc("/push/all", self.handlePushAll)
+	mux.HandleFunc("/list/clients", self.handleListClients)
+	mux.HandleFunc("/list/topics", self.handleListTopics)
+	
+	glog.Info("http api start: ", self.cfg.HttpListen)
+	err := http.ListenAndServe(self.cfg.HttpListen, mux)
+	if err != nil {
+		glog.Error(err.Error())
+	}
+}
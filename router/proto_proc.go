@@ -1,96 +1,234 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package main
-
-import (
-	"flag"
-	"github.com/golang/glog"
-	"github.com/funny/link"
-	"github.com/oikomi/gopush/protocol"
-	"github.com/oikomi/gopush/common"
-)
-
-func init() {
-	flag.Set("alsologtostderr", "true")
-	flag.Set("log_dir", "false")
-}
-
-type ProtoProc struct {
-	Router   *Router
-}
-
-func NewProtoProc(r *Router) *ProtoProc {
-	return &ProtoProc {
-		Router : r,
-	}
-}
-
-func (self *ProtoProc)procSendMsgP2P(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procSendMsgP2P")
-	var err error
-	send2ID := cmd.GetArgs()[0]
-	send2Msg := cmd.GetArgs()[1]
-	glog.Info(send2Msg)
-	self.Router.readMutex.Lock()
-	defer self.Router.readMutex.Unlock()
-	store_session, err := common.GetSessionFromCID(self.Router.sessionStore, send2ID)
-	if err != nil {
-		glog.Warningf("no ID : %s", send2ID)
-		
-		return err
-	}
-	glog.Info(store_session.MsgServerAddr)
-	
-	cmd.ChangeCmdName(protocol.ROUTE_MESSAGE_P2P_CMD)
-	
-	err = self.Router.msgServerClientMap[store_session.MsgServerAddr].Send(link.JSON {
-		cmd,
-	})
-	if err != nil {
-		glog.Error("error:", err)
-		return err
-	}
-	
-	return nil
-}
-
-func (self *ProtoProc)procCreateTopic(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procCreateTopic")
-	topicName := cmd.GetArgs()[0]
-	serverAddr := cmd.GetAnyData().(string)
-	self.Router.topicServerMap[topicName] = serverAddr
-	
-	return nil
-}
-
-func (self *ProtoProc)procJoinTopic(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procJoinTopic")
-	
-	return nil
-}
-
-
-func (self *ProtoProc)procSendMsgTopic(cmd protocol.Cmd, session *link.Session) error {
-	glog.Info("procSendMsgTopic")
-	//var err error
-	//topicName := string(cmd.Args[0])
-	//send2Msg := string(cmd.Args[1])
-
-	
-	return nil
-}
-
-
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"github.com/golang/glog"
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/protocol"
+	"github.com/oikomi/gopush/common"
+)
+
+func init() {
+	flag.Set("alsologtostderr", "true")
+	flag.Set("log_dir", "false")
+}
+
+type ProtoProc struct {
+	Router   *Router
+}
+
+func NewProtoProc(r *Router) *ProtoProc {
+	return &ProtoProc {
+		Router : r,
+	}
+}
+
+// Route a P2P message to every msg_server the target has a device on. The
+// sender was told the message is SENT, so a message that reaches no
+// msg_server is kept in the offline inbox of the target.
+func (self *ProtoProc)procSendMsgP2P(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procSendMsgP2P")
+	var err error
+	if len(cmd.GetArgs()) < 4 {
+		return BADARGS
+	}
+	send2ID := cmd.GetArgs()[0]
+	send2Msg := cmd.GetArgs()[1]
+	fromID := cmd.GetArgs()[2]
+	msgID := cmd.GetArgs()[3]
+	glog.Info(send2Msg)
+	store_session, err := common.GetSessionFromCID(self.Router.sessionStore, send2ID)
+	if err != nil {
+		glog.Warningf("no ID : %s", send2ID)
+		
+		return self.Router.storeOffline(msgID, send2ID, fromID, send2Msg)
+	}
+	glog.Info(store_session.MsgServerAddr)
+	
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.ROUTE_MESSAGE_P2P_CMD
+	routeCmd.Args = append(routeCmd.Args, send2ID)
+	routeCmd.Args = append(routeCmd.Args, send2Msg)
+	routeCmd.Args = append(routeCmd.Args, fromID)
+	routeCmd.Args = append(routeCmd.Args, msgID)
+	
+	routed := false
+	for _, addr := range store_session.MsgServerAddrs() {
+		msc, err := self.Router.getMsgServerClient(addr)
+		if err != nil {
+			glog.Warningf("no msg_server : %s", addr)
+			continue
+		}
+		err = msc.Send(link.JSON {
+			routeCmd,
+		})
+		if err != nil {
+			glog.Error("error:", err)
+			continue
+		}
+		routed = true
+	}
+	if !routed {
+		return self.Router.storeOffline(msgID, send2ID, fromID, send2Msg)
+	}
+	
+	return nil
+}
+
+// Kick the client off the msg_server it was logged in before.
+func (self *ProtoProc)procKickClient(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procKickClient")
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	msgServerAddr := cmd.GetArgs()[1]
+	
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.ROUTE_KICK_CLIENT_CMD
+	routeCmd.Args = append(routeCmd.Args, cmd.GetArgs()[0])
+	
+	msc, err := self.Router.getMsgServerClient(msgServerAddr)
+	if err != nil {
+		glog.Warningf("no msg_server : %s", msgServerAddr)
+		return err
+	}
+	err = msc.Send(link.JSON {
+		routeCmd,
+	})
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procDeliveryReport(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procDeliveryReport")
+	var err error
+	if len(cmd.GetArgs()) < 4 {
+		return BADARGS
+	}
+	fromID := cmd.GetArgs()[3]
+	store_session, err := common.GetSessionFromCID(self.Router.sessionStore, fromID)
+	if err != nil {
+		glog.Warningf("no ID : %s", fromID)
+		
+		return err
+	}
+	
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.ROUTE_DELIVERY_REPORT_CMD
+	routeCmd.Args = cmd.GetArgs()
+	
+	msc, err := self.Router.getMsgServerClient(store_session.MsgServerAddr)
+	if err != nil {
+		glog.Warningf("no msg_server : %s", store_session.MsgServerAddr)
+		return err
+	}
+	err = msc.Send(link.JSON {
+		routeCmd,
+	})
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	return nil
+}
+
+// Pass a topic command to the msg_server which holds the topic.
+func (self *ProtoProc)procForwardTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procForwardTopic")
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	hostAddr := cmd.GetArgs()[0]
+	
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.ROUTE_TOPIC_CMD
+	routeCmd.Args = append(routeCmd.Args, cmd.GetArgs()[1:]...)
+	
+	msc, err := self.Router.getMsgServerClient(hostAddr)
+	if err != nil {
+		glog.Warningf("no msg_server : %s", hostAddr)
+		return err
+	}
+	err = msc.Send(link.JSON {
+		routeCmd,
+	})
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	return nil
+}
+
+// Pass the reply of the msg_server holding a topic to the msg_server the
+// client is on.
+func (self *ProtoProc)procForwardTopicReply(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procForwardTopicReply")
+	if len(cmd.GetArgs()) < 2 {
+		return BADARGS
+	}
+	msgServerAddr := cmd.GetArgs()[0]
+	
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.ROUTE_TOPIC_REPLY_CMD
+	routeCmd.Args = append(routeCmd.Args, cmd.GetArgs()[1:]...)
+	
+	msc, err := self.Router.getMsgServerClient(msgServerAddr)
+	if err != nil {
+		glog.Warningf("no msg_server : %s", msgServerAddr)
+		return err
+	}
+	err = msc.Send(link.JSON {
+		routeCmd,
+	})
+	if err != nil {
+		glog.Error("error:", err)
+		return err
+	}
+	
+	return nil
+}
+
+func (self *ProtoProc)procJoinTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procJoinTopic")
+	
+	return nil
+}
+
+
+func (self *ProtoProc)procSendMsgTopic(cmd protocol.Cmd, session *link.Session) error {
+	glog.Info("procSendMsgTopic")
+	if len(cmd.GetArgs()) < 4 {
+		return BADARGS
+	}
+	var err error
+	topicName := cmd.GetArgs()[0]
+	send2Msg := cmd.GetArgs()[1]
+	fromID := cmd.GetArgs()[2]
+	fromServer := cmd.GetArgs()[3]
+	glog.Info(send2Msg)
+	_, err = self.Router.routeTopicMsg(topicName, send2Msg, fromID, fromServer)
+	
+	return err
+}
+
@@ -19,6 +19,7 @@ import (
 	"os"
 	"encoding/json"
 	"github.com/golang/glog"
+	"github.com/oikomi/gopush/common"
 	"time"
 )
 
@@ -28,19 +29,34 @@ type RouterConfig struct {
 	Listen             string
 	LogFile            string
 	UUID               string
-	MsgServerList      []string
+	WatchInterval        time.Duration
+	ReconnectInterval    time.Duration
+	MaxReconnectInterval time.Duration
+	TLS                  common.TLSConfig
+	MsgServerTLS         common.TLSConfig
+	PeerSecret           string
+	HttpListen           string
+	HttpApiKey           string
+	OfflineMsgExpire     time.Duration
+	OfflineMsgMaxCount   int
 	Redis struct { 
 		Addr string 
 		Port string
 		ConnectTimeout time.Duration
 		ReadTimeout time.Duration
 		WriteTimeout time.Duration
+		MaxIdle int
+		MaxActive int
+		IdleTimeout time.Duration
 	} 
 }
 
 func NewRouterConfig(configfile string) *RouterConfig {
 	return &RouterConfig {
-		configfile : configfile,
+		configfile           : configfile,
+		WatchInterval        : 5,
+		ReconnectInterval    : 1,
+		MaxReconnectInterval : 60,
 	}
 }
 
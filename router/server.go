@@ -1,142 +1,358 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package main
-
-import (
-	"sync"
-	"time"
-	"encoding/json"
-	"github.com/golang/glog"
-	"github.com/funny/link"
-	"github.com/oikomi/gopush/protocol"
-	"github.com/oikomi/gopush/storage"
-)
-
-type Router struct {
-	cfg                 *RouterConfig
-	msgServerClientMap  map[string]*link.Session
-	sessionStore        *storage.SessionStore
-	topicServerMap      map[string]string
-	readMutex           sync.Mutex
-}   
-
-func NewRouter(cfg *RouterConfig) *Router {
-	return &Router {
-		cfg                : cfg,
-		msgServerClientMap : make(map[string]*link.Session),
-		sessionStore       : storage.NewSessionStore(storage.NewRedisStore(&storage.RedisStoreOptions {
-					Network :   "tcp",
-					Address :   cfg.Redis.Port,
-					ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
-					ReadTimeout : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
-					WriteTimeout : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
-					Database :  1,
-					KeyPrefix : "push",
-		})),
-		topicServerMap     : make(map[string]string),
-	}
-}
-
-func (self *Router)connectMsgServer(ms string) (*link.Session, error) {
-	p := link.PacketN(2, link.BigEndianBO, link.LittleEndianBF)
-	client, err := link.Dial("tcp", ms, p)
-	if err != nil {
-		glog.Error(err.Error())
-		panic(err)
-	}
-
-	return client, err
-}
-
-func (self *Router)handleMsgServerClient(msc *link.Session) {
-	msc.ReadLoop(func(msg link.InBuffer) {
-		glog.Info("msg_server", msc.Conn().RemoteAddr().String()," say: ", string(msg.Get()))
-		var c protocol.CmdInternal
-		pp := NewProtoProc(self)
-		err := json.Unmarshal(msg.Get(), &c)
-		if err != nil {
-			glog.Error("error:", err)
-		}
-		switch c.GetCmdName() {
-			case protocol.SEND_MESSAGE_P2P_CMD:
-				err := pp.procSendMsgP2P(c, msc)
-				if err != nil {
-					glog.Warning(err.Error())
-				}
-			case protocol.CREATE_TOPIC_CMD:
-				err := pp.procCreateTopic(c, msc)
-				if err != nil {
-					glog.Warning(err.Error())
-				}
-			case protocol.JOIN_TOPIC_CMD:
-				err := pp.procJoinTopic(c, msc)
-				if err != nil {
-					glog.Warning(err.Error())
-				}
-			case protocol.SEND_MESSAGE_TOPIC_CMD:
-				err := pp.procSendMsgTopic(c, msc)
-				if err != nil {
-					glog.Warning(err.Error())
-				}
-				
-			}
-	})
-}
-
-func (self *Router)subscribeChannels() error {
-	glog.Info("subscribeChannels")
-	for _, ms := range self.cfg.MsgServerList {
-		msgServerClient, err := self.connectMsgServer(ms)
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-		cmd := protocol.NewCmdSimple()
-		
-		cmd.CmdName = protocol.SUBSCRIBE_CHANNEL_CMD
-		cmd.Args = append(cmd.Args, protocol.SYSCTRL_SEND)
-		cmd.Args = append(cmd.Args, self.cfg.UUID)
-		
-		err = msgServerClient.Send(link.JSON {
-			cmd,
-		})
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-		
-		cmd = protocol.NewCmdSimple()
-		
-		cmd.CmdName = protocol.SUBSCRIBE_CHANNEL_CMD
-		cmd.Args = append(cmd.Args, protocol.SYSCTRL_TOPIC_SYNC)
-		cmd.Args = append(cmd.Args, self.cfg.UUID)
-		
-		err = msgServerClient.Send(link.JSON {
-			cmd,
-		})
-		if err != nil {
-			glog.Error(err.Error())
-			return err
-		}
-		
-		self.msgServerClientMap[ms] = msgServerClient
-	}
-
-	for _, msc := range self.msgServerClientMap {
-		go self.handleMsgServerClient(msc)
-	}
-	return nil
-}
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+	"encoding/json"
+	"github.com/golang/glog"
+	"github.com/funny/link"
+	"github.com/oikomi/gopush/common"
+	"github.com/oikomi/gopush/protocol"
+	"github.com/oikomi/gopush/storage"
+)
+
+type Router struct {
+	cfg                 *RouterConfig
+	msgServerClientMap  map[string]*link.Session
+	msgServerClientMutex sync.RWMutex
+	msgServerKeepers    map[string]bool
+	sessionStore        storage.SessionStore
+	topicStore          storage.TopicStore
+	msgServerStore      *storage.MsgServerStore
+	offlineMsgStore     *storage.OfflineMsgStore
+	startTime           int64
+	msgIDSeq            uint64
+}   
+
+func NewRouter(cfg *RouterConfig) *Router {
+	rs := storage.NewRedisStore(&storage.RedisStoreOptions {
+		Network        : "tcp",
+		Address        : cfg.Redis.Port,
+		ConnectTimeout : time.Duration(cfg.Redis.ConnectTimeout)*time.Millisecond,
+		ReadTimeout    : time.Duration(cfg.Redis.ReadTimeout)*time.Millisecond,
+		WriteTimeout   : time.Duration(cfg.Redis.WriteTimeout)*time.Millisecond,
+		Database       : 1,
+		KeyPrefix      : "push",
+		MaxIdle        : cfg.Redis.MaxIdle,
+		MaxActive      : cfg.Redis.MaxActive,
+		IdleTimeout    : cfg.Redis.IdleTimeout*time.Second,
+	})
+	backend := &storage.BackendOptions {
+		Redis : rs,
+	}
+	return &Router {
+		cfg                : cfg,
+		msgServerClientMap : make(map[string]*link.Session),
+		msgServerKeepers   : make(map[string]bool),
+		sessionStore       : storage.NewSessionStore(backend),
+		topicStore         : storage.NewTopicStore(backend),
+		msgServerStore     : storage.NewMsgServerStore(rs),
+		offlineMsgStore    : storage.NewOfflineMsgStore(rs),
+		startTime          : time.Now().Unix(),
+	}
+}
+
+func (self *Router)connectMsgServer(ms string) (*link.Session, error) {
+	p := link.PacketN(2, link.BigEndianBO, link.LittleEndianBF)
+	client, err := common.Dial("tcp", ms, &self.cfg.MsgServerTLS, p)
+	if err != nil {
+		glog.Error(err.Error())
+		return nil, err
+	}
+
+	return client, err
+}
+
+// Keep a P2P message in the offline inbox of send2ID, to be replayed when
+// it logs in again.
+func (self *Router)storeOffline(msgID string, send2ID string, fromID string, send2Msg string) error {
+	msg := storage.NewOfflineMsgData(msgID, send2ID, fromID, send2Msg)
+	return self.offlineMsgStore.Push(msg, self.cfg.OfflineMsgExpire * time.Second, self.cfg.OfflineMsgMaxCount)
+}
+
+func (self *Router)getMsgServerClient(ms string) (*link.Session, error) {
+	self.msgServerClientMutex.RLock()
+	defer self.msgServerClientMutex.RUnlock()
+	msc := self.msgServerClientMap[ms]
+	if msc == nil {
+		return nil, NOMSGSERVER
+	}
+	
+	return msc, nil
+}
+
+func (self *Router)setMsgServerClient(ms string, msc *link.Session) {
+	self.msgServerClientMutex.Lock()
+	defer self.msgServerClientMutex.Unlock()
+	if msc == nil {
+		delete(self.msgServerClientMap, ms)
+	} else {
+		self.msgServerClientMap[ms] = msc
+	}
+}
+
+// Route a topic message to every msg_server, except fromServer, that hosts
+// the topic or one of its members. Members are read from the store a page
+// at a time and looked up on the msg_server recorded for them, or else on the
+// one their session is on. It returns the delivery status of every member.
+func (self *Router)routeTopicMsg(topicName string, send2Msg string, fromID string, 
+	fromServer string) ([]*PushResult, error) {
+	topicStoreData, err := common.GetTopicFromTopicName(self.topicStore, topicName)
+	if err != nil {
+		glog.Warningf("no topicName : %s", topicName)
+		return nil, err
+	}
+	
+	results := make([]*PushResult, 0)
+	memberAddrs := make(map[string]string)
+	serverAddrs := make(map[string]error)
+	if topicStoreData.MsgServerAddr != fromServer {
+		serverAddrs[topicStoreData.MsgServerAddr] = nil
+	}
+	var cursor uint64
+	for {
+		members, next, err := self.topicStore.ScanMembers(topicName, cursor, common.TopicMemberPage)
+		if err != nil {
+			glog.Error("error:", err)
+			return nil, err
+		}
+		for _, m := range members {
+			addr := m.MsgServerAddr
+			if addr == "" {
+				store_session, err := common.GetSessionFromCID(self.sessionStore, m.ID)
+				if err != nil {
+					glog.Warningf("no ID : %s", m.ID)
+					results = append(results, NewPushResult(m.ID, protocol.DELIVERY_STATUS_OFFLINE, nil))
+					continue
+				}
+				addr = store_session.MsgServerAddr
+			}
+			memberAddrs[m.ID] = addr
+			if addr != fromServer {
+				serverAddrs[addr] = nil
+			}
+		}
+		if next == 0 {
+			break
+		}
+		cursor = next
+	}
+	
+	routeCmd := protocol.NewCmdSimple()
+	routeCmd.CmdName = protocol.ROUTE_MESSAGE_TOPIC_CMD
+	routeCmd.Args = append(routeCmd.Args, topicName)
+	routeCmd.Args = append(routeCmd.Args, send2Msg)
+	routeCmd.Args = append(routeCmd.Args, fromID)
+	
+	for addr := range serverAddrs {
+		msc, err := self.getMsgServerClient(addr)
+		if err != nil {
+			glog.Warningf("no msg_server : %s", addr)
+			serverAddrs[addr] = err
+			continue
+		}
+		err = msc.Send(link.JSON {
+			routeCmd,
+		})
+		if err != nil {
+			glog.Error("error:", err)
+			serverAddrs[addr] = err
+		}
+	}
+	
+	for id, addr := range memberAddrs {
+		err, routed := serverAddrs[addr]
+		if !routed {
+			// delivered by fromServer itself
+			results = append(results, NewPushResult(id, protocol.DELIVERY_STATUS_ROUTED, nil))
+		} else if err != nil {
+			results = append(results, NewPushResult(id, protocol.DELIVERY_STATUS_FAILED, err))
+		} else {
+			results = append(results, NewPushResult(id, protocol.DELIVERY_STATUS_ROUTED, nil))
+		}
+	}
+	
+	return results, nil
+}
+
+func (self *Router)handleMsgServerClient(msc *link.Session) {
+	msc.ReadLoop(func(msg link.InBuffer) {
+		glog.Info("msg_server", msc.Conn().RemoteAddr().String()," say: ", string(msg.Get()))
+		var c protocol.CmdInternal
+		// a malformed command must not bring the whole router down
+		defer func() {
+			if r := recover(); r != nil {
+				glog.Errorf("%s from %s panics : %v", c.CmdName, msc.Conn().RemoteAddr().String(), r)
+			}
+		}()
+		
+		pp := NewProtoProc(self)
+		err := json.Unmarshal(msg.Get(), &c)
+		if err != nil {
+			glog.Error("error:", err)
+			return
+		}
+		switch c.GetCmdName() {
+			case protocol.SEND_MESSAGE_P2P_CMD:
+				err := pp.procSendMsgP2P(c, msc)
+				if err != nil {
+					glog.Warning(err.Error())
+				}
+			case protocol.DELIVERY_REPORT_CMD:
+				err := pp.procDeliveryReport(c, msc)
+				if err != nil {
+					glog.Warning(err.Error())
+				}
+			case protocol.KICK_CLIENT_CMD:
+				err := pp.procKickClient(c, msc)
+				if err != nil {
+					glog.Warning(err.Error())
+				}
+			case protocol.JOIN_TOPIC_CMD:
+				err := pp.procJoinTopic(c, msc)
+				if err != nil {
+					glog.Warning(err.Error())
+				}
+			case protocol.FORWARD_TOPIC_CMD:
+				err := pp.procForwardTopic(c, msc)
+				if err != nil {
+					glog.Warning(err.Error())
+				}
+			case protocol.FORWARD_TOPIC_REPLY_CMD:
+				err := pp.procForwardTopicReply(c, msc)
+				if err != nil {
+					glog.Warning(err.Error())
+				}
+			case protocol.SEND_MESSAGE_TOPIC_CMD:
+				err := pp.procSendMsgTopic(c, msc)
+				if err != nil {
+					glog.Warning(err.Error())
+				}
+				
+			}
+	})
+}
+
+func (self *Router)subscribeChannel(msc *link.Session, channelName string, token string) error {
+	cmd := protocol.NewCmdSimple()
+	
+	cmd.CmdName = protocol.SUBSCRIBE_CHANNEL_CMD
+	cmd.Args = append(cmd.Args, channelName)
+	cmd.Args = append(cmd.Args, self.cfg.UUID)
+	if token != "" {
+		cmd.Args = append(cmd.Args, token)
+	}
+	
+	err := msc.Send(link.JSON {
+		cmd,
+	})
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	return nil
+}
+
+// Keep a link to the msg_server ms on its peer address addr. The link is
+// redialed with exponential backoff whenever it can not be made or is lost,
+// and the channels are subscribed again on every new link.
+func (self *Router)keepMsgServerClient(ms string, addr string) {
+	glog.Info("keepMsgServerClient ", ms, " ", addr)
+	retry := self.cfg.ReconnectInterval * time.Second
+	for {
+		token := ""
+		msgServerClient, err := self.connectMsgServer(addr)
+		if err == nil && self.cfg.PeerSecret != "" {
+			token, err = common.PeerToken(msgServerClient, self.cfg.PeerSecret, self.cfg.UUID)
+		}
+		if err == nil {
+			err = self.subscribeChannel(msgServerClient, protocol.SYSCTRL_SEND, token)
+		}
+		if err == nil {
+			err = self.subscribeChannel(msgServerClient, protocol.SYSCTRL_TOPIC_SYNC, token)
+		}
+		if err == nil {
+			retry = self.cfg.ReconnectInterval * time.Second
+			self.setMsgServerClient(ms, msgServerClient)
+			self.handleMsgServerClient(msgServerClient)
+			self.setMsgServerClient(ms, nil)
+			glog.Warningf("lost msg_server : %s", ms)
+		} else if msgServerClient != nil {
+			msgServerClient.Close(nil)
+		}
+		
+		if !self.keepingMsgServer(ms) {
+			glog.Infof("msg_server %s unregistered", ms)
+			return
+		}
+		glog.Infof("reconnect msg_server %s in %s", ms, retry)
+		time.Sleep(retry)
+		retry = retry * 2
+		if retry > self.cfg.MaxReconnectInterval * time.Second {
+			retry = self.cfg.MaxReconnectInterval * time.Second
+		}
+	}
+}
+
+// Stop the keeper of ms if ms has left the registry.
+func (self *Router)keepingMsgServer(ms string) bool {
+	self.msgServerClientMutex.Lock()
+	defer self.msgServerClientMutex.Unlock()
+	if !self.msgServerKeepers[ms] {
+		delete(self.msgServerKeepers, ms)
+		return false
+	}
+	
+	return true
+}
+
+func (self *Router)updateMsgServers() error {
+	list, err := self.msgServerStore.List()
+	if err != nil {
+		glog.Error(err.Error())
+		return err
+	}
+	
+	self.msgServerClientMutex.Lock()
+	defer self.msgServerClientMutex.Unlock()
+	for ms := range self.msgServerKeepers {
+		self.msgServerKeepers[ms] = false
+	}
+	for _, ms := range list {
+		_, ok := self.msgServerKeepers[ms.MsgServerAddr]
+		self.msgServerKeepers[ms.MsgServerAddr] = true
+		if !ok {
+			glog.Info("new msg_server ", ms.MsgServerAddr)
+			go self.keepMsgServerClient(ms.MsgServerAddr, ms.PeerAddr())
+		}
+	}
+	
+	return nil
+}
+
+// Watch the msg_server registry and keep a subscribed link to every
+// registered msg_server.
+func (self *Router)watchMsgServers() {
+	glog.Info("watchMsgServers")
+	timer := time.NewTicker(self.cfg.WatchInterval * time.Second)
+	for {
+		self.updateMsgServers()
+		<-timer.C
+	}
+}
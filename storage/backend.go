@@ -0,0 +1,84 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sync"
+	"errors"
+)
+
+var (
+	ErrBadBackend = errors.New("unknown store backend")
+)
+
+// The backends the session and topic stores can be kept in.
+const (
+	BACKEND_REDIS   = "redis"
+	BACKEND_MEMORY  = "memory"
+)
+
+// BackendOptions picks the backend of the session and topic stores. Redis
+// is used when Backend is empty. msg_server, router and manager are separate
+// processes which read each other's stores, so they always run on redis. The
+// memory backend lives in one process and is for tests and embedding only.
+type BackendOptions struct {
+	Backend   string
+	Redis     *RedisStore
+}
+
+var (
+	memoryStore      *MemoryStore
+	memoryStoreMutex sync.Mutex
+)
+
+func newKVStore(opts *BackendOptions) (KVStore, error) {
+	switch opts.Backend {
+		case BACKEND_MEMORY:
+			memoryStoreMutex.Lock()
+			defer memoryStoreMutex.Unlock()
+			if memoryStore == nil {
+				memoryStore = NewMemoryStore()
+			}
+			return memoryStore, nil
+	}
+	return nil, ErrBadBackend
+}
+
+// Create the session store of the backend. It panics when the backend can
+// not be opened.
+func NewSessionStore(opts *BackendOptions) SessionStore {
+	if opts.Backend == "" || opts.Backend == BACKEND_REDIS {
+		return NewRedisSessionStore(opts.Redis)
+	}
+	kv, err := newKVStore(opts)
+	if err != nil {
+		panic(err)
+	}
+	return NewKVSessionStore(kv)
+}
+
+// Create the topic store of the backend. It panics when the backend can not
+// be opened.
+func NewTopicStore(opts *BackendOptions) TopicStore {
+	if opts.Backend == "" || opts.Backend == BACKEND_REDIS {
+		return NewRedisTopicStore(opts.Redis)
+	}
+	kv, err := newKVStore(opts)
+	if err != nil {
+		panic(err)
+	}
+	return NewKVTopicStore(kv)
+}
@@ -1,21 +1,115 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package storage
-
-type Store interface {
-	StoreKey() string
-	StoreData() interface{}
-}
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+)
+
+type Store interface {
+	StoreKey() string
+	StoreData() interface{}
+}
+
+// SessionStore keeps the session of each client ID and the clients each
+// msg_server has sessions of. The redis and memory backends implement it.
+// Get returns ErrNotFound for a client without a session.
+type SessionStore interface {
+	Get(clientID string) (*SessionStoreData, error)
+	Set(sess *SessionStoreData) error
+	Delete(clientID string) error
+	Clear() error
+	Len() int
+	Scan(cursor uint64, count int) ([]string, uint64, error)
+	AddHostSession(msgServerAddr string, clientID string) error
+	RemoveHostSession(msgServerAddr string, clientID string) error
+	GetHostSessions(msgServerAddr string) ([]string, error)
+}
+
+// TopicStore keeps the topics, the topics each client is a member of and
+// the topics each msg_server holds. The metadata of a topic and its members
+// are kept apart, so Get and Set leave MemberList alone and every member
+// is added or removed on its own. Get returns ErrNotFound for a missing topic.
+type TopicStore interface {
+	Get(topicName string) (*TopicStoreData, error)
+	Set(t *TopicStoreData) error
+	Delete(topicName string) error
+	Clear() error
+	Len() int
+	Scan(cursor uint64, count int) ([]string, uint64, error)
+	AddMember(topicName string, m *Member) error
+	RemoveMember(topicName string, id string) error
+	IsMember(topicName string, id string) (bool, error)
+	CountMembers(topicName string) (int, error)
+	GetMember(topicName string, id string) (*Member, error)
+	ScanMembers(topicName string, cursor uint64, count int) ([]*Member, uint64, error)
+	AddClientTopic(clientID string, topicName string) error
+	RemoveClientTopic(clientID string, topicName string) error
+	GetClientTopics(clientID string) ([]string, error)
+	AddHostTopic(msgServerAddr string, topicName string) error
+	RemoveHostTopic(msgServerAddr string, topicName string) error
+	GetHostTopics(msgServerAddr string) ([]string, error)
+	GetHosts() ([]string, error)
+	MoveTopic(topicName string, from string, to string) (bool, error)
+}
+
+// Records asked for per page when a store is walked.
+const DEFAULT_SCAN_COUNT = 100
+
+// ScanFunc gets a page of about count ids starting at cursor, and the cursor
+// of the next page. The first page starts at cursor 0, and the next cursor
+// is 0 after the last page. SessionStore.Scan and TopicStore.Scan are ScanFuncs.
+type ScanFunc func(cursor uint64, count int) ([]string, uint64, error)
+
+// Call fn with every page of scan, up to the last page or the first error.
+func ScanEach(scan ScanFunc, count int, fn func(ids []string) error) error {
+	var cursor uint64
+	for {
+		ids, next, err := scan(cursor, count)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			err = fn(ids)
+			if err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Count the distinct ids of scan, or -1 on error.
+func scanLen(scan ScanFunc) int {
+	seen := make(map[string]bool)
+	err := ScanEach(scan, DEFAULT_SCAN_COUNT, func(ids []string) error {
+		for _, id := range ids {
+			seen[id] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return -1
+	}
+	return len(seen)
+}
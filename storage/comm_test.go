@@ -0,0 +1,112 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"errors"
+	"strconv"
+	"reflect"
+	"testing"
+)
+
+func TestScanEach(t *testing.T) {
+	errStop := errors.New("stop")
+	tests := []struct {
+		name   string
+		ids    int
+		count  int
+		stopAt int
+		pages  int
+		err    error
+	}{
+		{"empty", 0, 2, -1, 0, nil},
+		{"one page", 2, 2, -1, 1, nil},
+		{"pages", 5, 2, -1, 3, nil},
+		{"stopped by fn", 5, 2, 1, 2, errStop},
+	}
+	for _, tt := range tests {
+		kv := NewMemoryStore()
+		want := make([]string, 0)
+		for i := 0; i < tt.ids; i++ {
+			id := "c" + strconv.Itoa(i)
+			kv.Set(KV_SESSION_PREFIX + id, nil, defaultTTL)
+			want = append(want, id)
+		}
+		store := NewKVSessionStore(kv)
+		
+		got := make([]string, 0)
+		pages := 0
+		err := ScanEach(store.Scan, tt.count, func(ids []string) error {
+			if pages == tt.stopAt {
+				pages++
+				return errStop
+			}
+			pages++
+			got = append(got, ids...)
+			return nil
+		})
+		if err != tt.err || pages != tt.pages {
+			t.Errorf("%s: ScanEach = %v after %d pages, want %v after %d", tt.name, err, pages, tt.err, tt.pages)
+		}
+		if tt.err == nil && !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: ScanEach saw %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestScanEachScanError(t *testing.T) {
+	errScan := errors.New("scan failed")
+	calls := 0
+	scan := func(cursor uint64, count int) ([]string, uint64, error) {
+		calls++
+		if cursor > 0 {
+			return nil, 0, errScan
+		}
+		return []string{"a"}, 1, nil
+	}
+	err := ScanEach(scan, 1, func(ids []string) error {
+		return nil
+	})
+	if err != errScan || calls != 2 {
+		t.Errorf("ScanEach = %v after %d scans, want %v after 2", err, calls, errScan)
+	}
+}
+
+func TestScanLen(t *testing.T) {
+	tests := []struct {
+		name  string
+		pages [][]string
+		want  int
+	}{
+		{"empty", [][]string{{}}, 0},
+		{"pages", [][]string{{"a", "b"}, {"c"}}, 3},
+		// SCAN may return an id more than once
+		{"repeated ids", [][]string{{"a", "b"}, {"b", "c"}}, 3},
+	}
+	for _, tt := range tests {
+		pages := tt.pages
+		scan := func(cursor uint64, count int) ([]string, uint64, error) {
+			next := cursor + 1
+			if int(next) == len(pages) {
+				next = 0
+			}
+			return pages[cursor], next, nil
+		}
+		if n := scanLen(scan); n != tt.want {
+			t.Errorf("%s: scanLen = %d, want %d", tt.name, n, tt.want)
+		}
+	}
+}
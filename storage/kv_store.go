@@ -0,0 +1,420 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sync"
+	"time"
+	"strings"
+	"encoding/json"
+)
+
+// Keys of the stores on a KVStore.
+const (
+	KV_SESSION_PREFIX           = "session:"
+	KV_TOPIC_PREFIX             = "topic:"
+	KV_TOPIC_MEMBERS_PREFIX     = "topicmembers:"
+	KV_TOPIC_MEMBER_INFO_PREFIX = "topicmemberinfo:"
+	KV_CLIENT_TOPICS_PREFIX     = "mytopics:"
+	KV_HOST_TOPICS_PREFIX       = "hosttopics:"
+	KV_HOSTS_KEY                = "hosts"
+	KV_HOST_SESSIONS_PREFIX     = "hostsessions:"
+)
+
+const defaultTTL = 2 * 24 * time.Hour
+
+// KVStore is a key value store with sets. The memory backend implements it, and KVSessionStore and KVTopicStore are built on it. Get
+// returns ErrNotFound for a missing or expired key.
+type KVStore interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+	Keys(prefix string) ([]string, error)
+	SAdd(key string, member string) error
+	SRem(key string, member string) error
+	SMembers(key string) ([]string, error)
+}
+
+func storeTTL(maxAge time.Duration) time.Duration {
+	if maxAge == 0 {
+		return defaultTTL
+	}
+	return maxAge
+}
+
+// KVSessionStore is the SessionStore on a KVStore.
+type KVSessionStore struct {
+	kv  KVStore
+}
+
+func NewKVSessionStore(kv KVStore) *KVSessionStore {
+	return &KVSessionStore {
+		kv : kv,
+	}
+}
+
+func (self *KVSessionStore) Get(clientID string) (*SessionStoreData, error) {
+	b, err := self.kv.Get(KV_SESSION_PREFIX + clientID)
+	if err != nil {
+		return nil, err
+	}
+	var sess SessionStoreData
+	err = json.Unmarshal(b, &sess)
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+func (self *KVSessionStore) Set(sess *SessionStoreData) error {
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	return self.kv.Set(KV_SESSION_PREFIX + sess.ClientID, b, storeTTL(sess.MaxAge))
+}
+
+func (self *KVSessionStore) Delete(clientID string) error {
+	return self.kv.Delete(KV_SESSION_PREFIX + clientID)
+}
+
+func (self *KVSessionStore) Clear() error {
+	return clearKeys(self.kv, KV_SESSION_PREFIX)
+}
+
+func (self *KVSessionStore) Len() int {
+	keys, err := self.kv.Keys(KV_SESSION_PREFIX)
+	if err != nil {
+		return -1
+	}
+	return len(keys)
+}
+
+func (self *KVSessionStore) Scan(cursor uint64, count int) ([]string, uint64, error) {
+	return scanKeys(self.kv, KV_SESSION_PREFIX, cursor, count)
+}
+
+func (self *KVSessionStore) AddHostSession(msgServerAddr string, clientID string) error {
+	return self.kv.SAdd(KV_HOST_SESSIONS_PREFIX + msgServerAddr, clientID)
+}
+
+func (self *KVSessionStore) RemoveHostSession(msgServerAddr string, clientID string) error {
+	return self.kv.SRem(KV_HOST_SESSIONS_PREFIX + msgServerAddr, clientID)
+}
+
+func (self *KVSessionStore) GetHostSessions(msgServerAddr string) ([]string, error) {
+	return self.kv.SMembers(KV_HOST_SESSIONS_PREFIX + msgServerAddr)
+}
+
+// KVTopicStore is the TopicStore on a KVStore.
+type KVTopicStore struct {
+	kv         KVStore
+	moveMutex  sync.Mutex
+}
+
+func NewKVTopicStore(kv KVStore) *KVTopicStore {
+	return &KVTopicStore {
+		kv : kv,
+	}
+}
+
+// Get the metadata of the topic. MemberList is left empty as on Redis.
+func (self *KVTopicStore) Get(topicName string) (*TopicStoreData, error) {
+	b, err := self.kv.Get(KV_TOPIC_PREFIX + topicName)
+	if err != nil {
+		return nil, err
+	}
+	var t TopicStoreData
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		return nil, err
+	}
+	t.MemberList = make([]*Member, 0)
+	return &t, nil
+}
+
+// Save the metadata of the topic and renew the TTL of its members.
+func (self *KVTopicStore) Set(t *TopicStoreData) error {
+	meta := *t
+	meta.MemberList = nil
+	b, err := json.Marshal(&meta)
+	if err != nil {
+		return err
+	}
+	ttl := storeTTL(t.MaxAge)
+	err = self.kv.Set(KV_TOPIC_PREFIX + t.TopicName, b, ttl)
+	if err != nil {
+		return err
+	}
+	ids, err := self.kv.SMembers(KV_TOPIC_MEMBERS_PREFIX + t.TopicName)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		b, err = self.kv.Get(self.memberInfoKey(t.TopicName, id))
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = self.kv.Set(self.memberInfoKey(t.TopicName, id), b, ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *KVTopicStore)memberInfoKey(topicName string, id string) string {
+	return KV_TOPIC_MEMBER_INFO_PREFIX + topicName + ":" + id
+}
+
+func (self *KVTopicStore) AddMember(topicName string, m *Member) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	err = self.kv.Set(self.memberInfoKey(topicName, m.ID), b, defaultTTL)
+	if err != nil {
+		return err
+	}
+	return self.kv.SAdd(KV_TOPIC_MEMBERS_PREFIX + topicName, m.ID)
+}
+
+func (self *KVTopicStore) RemoveMember(topicName string, id string) error {
+	err := self.kv.SRem(KV_TOPIC_MEMBERS_PREFIX + topicName, id)
+	if err != nil {
+		return err
+	}
+	return self.kv.Delete(self.memberInfoKey(topicName, id))
+}
+
+func (self *KVTopicStore) IsMember(topicName string, id string) (bool, error) {
+	ids, err := self.kv.SMembers(KV_TOPIC_MEMBERS_PREFIX + topicName)
+	if err != nil {
+		return false, err
+	}
+	return containsID(ids, id), nil
+}
+
+func (self *KVTopicStore) CountMembers(topicName string) (int, error) {
+	ids, err := self.kv.SMembers(KV_TOPIC_MEMBERS_PREFIX + topicName)
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+func (self *KVTopicStore) GetMember(topicName string, id string) (*Member, error) {
+	ok, err := self.IsMember(topicName, id)
+	if err != nil || !ok {
+		return nil, err
+	}
+	b, err := self.kv.Get(self.memberInfoKey(topicName, id))
+	if err == ErrNotFound {
+		return decodeMember(id, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMember(id, b)
+}
+
+// The cursor is the offset in the sorted member set.
+func (self *KVTopicStore) ScanMembers(topicName string, cursor uint64, count int) ([]*Member, uint64, error) {
+	ids, err := self.kv.SMembers(KV_TOPIC_MEMBERS_PREFIX + topicName)
+	if err != nil {
+		return nil, 0, err
+	}
+	members := make([]*Member, 0)
+	if cursor >= uint64(len(ids)) {
+		return members, 0, nil
+	}
+	end := cursor + uint64(count)
+	next := end
+	if end >= uint64(len(ids)) {
+		end = uint64(len(ids))
+		next = 0
+	}
+	for _, id := range ids[cursor:end] {
+		m, err := self.GetMember(topicName, id)
+		if err != nil {
+			return nil, 0, err
+		}
+		if m != nil {
+			members = append(members, m)
+		}
+	}
+	return members, next, nil
+}
+
+func (self *KVTopicStore) Delete(topicName string) error {
+	ids, err := self.kv.SMembers(KV_TOPIC_MEMBERS_PREFIX + topicName)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err = self.kv.Delete(self.memberInfoKey(topicName, id))
+		if err != nil {
+			return err
+		}
+	}
+	err = self.kv.Delete(KV_TOPIC_MEMBERS_PREFIX + topicName)
+	if err != nil {
+		return err
+	}
+	return self.kv.Delete(KV_TOPIC_PREFIX + topicName)
+}
+
+func (self *KVTopicStore) Clear() error {
+	keys, err := self.kv.Keys(KV_TOPIC_PREFIX)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = self.Delete(strings.TrimPrefix(k, KV_TOPIC_PREFIX))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *KVTopicStore) Len() int {
+	keys, err := self.kv.Keys(KV_TOPIC_PREFIX)
+	if err != nil {
+		return -1
+	}
+	return len(keys)
+}
+
+func (self *KVTopicStore) Scan(cursor uint64, count int) ([]string, uint64, error) {
+	return scanKeys(self.kv, KV_TOPIC_PREFIX, cursor, count)
+}
+
+func (self *KVTopicStore) AddClientTopic(clientID string, topicName string) error {
+	return self.kv.SAdd(KV_CLIENT_TOPICS_PREFIX + clientID, topicName)
+}
+
+func (self *KVTopicStore) RemoveClientTopic(clientID string, topicName string) error {
+	return self.kv.SRem(KV_CLIENT_TOPICS_PREFIX + clientID, topicName)
+}
+
+func (self *KVTopicStore) GetClientTopics(clientID string) ([]string, error) {
+	return self.kv.SMembers(KV_CLIENT_TOPICS_PREFIX + clientID)
+}
+
+// The msg_servers which hold topics are kept in a set of their own, as the
+// sets are not listed by Keys.
+func (self *KVTopicStore) AddHostTopic(msgServerAddr string, topicName string) error {
+	err := self.kv.SAdd(KV_HOST_TOPICS_PREFIX + msgServerAddr, topicName)
+	if err != nil {
+		return err
+	}
+	return self.kv.SAdd(KV_HOSTS_KEY, msgServerAddr)
+}
+
+func (self *KVTopicStore) RemoveHostTopic(msgServerAddr string, topicName string) error {
+	err := self.kv.SRem(KV_HOST_TOPICS_PREFIX + msgServerAddr, topicName)
+	if err != nil {
+		return err
+	}
+	left, err := self.kv.SMembers(KV_HOST_TOPICS_PREFIX + msgServerAddr)
+	if err != nil || len(left) > 0 {
+		return err
+	}
+	return self.kv.SRem(KV_HOSTS_KEY, msgServerAddr)
+}
+
+func (self *KVTopicStore) GetHostTopics(msgServerAddr string) ([]string, error) {
+	return self.kv.SMembers(KV_HOST_TOPICS_PREFIX + msgServerAddr)
+}
+
+func (self *KVTopicStore) GetHosts() ([]string, error) {
+	return self.kv.SMembers(KV_HOSTS_KEY)
+}
+
+// The KVStore has no compare and set, so the moves are serialized here.
+func (self *KVTopicStore) MoveTopic(topicName string, from string, to string) (bool, error) {
+	self.moveMutex.Lock()
+	defer self.moveMutex.Unlock()
+	t, err := self.Get(topicName)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if t.MsgServerAddr != from {
+		return false, nil
+	}
+	t.MsgServerAddr = to
+	err = self.Set(t)
+	if err != nil {
+		return false, err
+	}
+	err = self.RemoveHostTopic(from, topicName)
+	if err != nil {
+		return false, err
+	}
+	return true, self.AddHostTopic(to, topicName)
+}
+
+func clearKeys(kv KVStore, prefix string) error {
+	keys, err := kv.Keys(prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = kv.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get a page of the keys with prefix, without the prefix. The cursor is the
+// offset in the sorted keys, so keys added or removed meanwhile may shift a
+// page.
+func scanKeys(kv KVStore, prefix string, cursor uint64, count int) ([]string, uint64, error) {
+	keys, err := kv.Keys(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	page, next := pageIDs(keys, cursor, count)
+	ids := make([]string, 0, len(page))
+	for _, k := range page {
+		ids = append(ids, strings.TrimPrefix(k, prefix))
+	}
+	return ids, next, nil
+}
+
+// Get the page of count ids at the offset cursor, and the offset of the
+// next page, which is 0 after the last page.
+func pageIDs(ids []string, cursor uint64, count int) ([]string, uint64) {
+	if cursor >= uint64(len(ids)) {
+		return []string {}, 0
+	}
+	end := cursor + uint64(count)
+	next := end
+	if end >= uint64(len(ids)) {
+		end = uint64(len(ids))
+		next = 0
+	}
+	return ids[cursor:end], next
+}
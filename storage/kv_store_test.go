@@ -0,0 +1,181 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"strconv"
+	"reflect"
+	"testing"
+)
+
+func memberIDs(members []*Member) []string {
+	ids := make([]string, 0)
+	for _, m := range members {
+		ids = append(ids, m.ID)
+	}
+	return ids
+}
+
+func TestKVTopicStoreScanMembers(t *testing.T) {
+	store := NewKVTopicStore(NewMemoryStore())
+	for i := 0; i < 5; i++ {
+		store.AddMember("news", NewMember("m" + strconv.Itoa(i)))
+	}
+	tests := []struct {
+		name   string
+		topic  string
+		cursor uint64
+		count  int
+		want   []string
+		next   uint64
+	}{
+		{"first page", "news", 0, 2, []string{"m0", "m1"}, 2},
+		{"middle page", "news", 2, 2, []string{"m2", "m3"}, 4},
+		{"last page", "news", 4, 2, []string{"m4"}, 0},
+		{"exact last page", "news", 3, 2, []string{"m3", "m4"}, 0},
+		{"all in one", "news", 0, 10, []string{"m0", "m1", "m2", "m3", "m4"}, 0},
+		{"past the end", "news", 9, 2, []string{}, 0},
+		{"no topic", "none", 0, 2, []string{}, 0},
+	}
+	for _, tt := range tests {
+		members, next, err := store.ScanMembers(tt.topic, tt.cursor, tt.count)
+		if err != nil {
+			t.Fatalf("%s: ScanMembers = %v", tt.name, err)
+		}
+		if ids := memberIDs(members); !reflect.DeepEqual(ids, tt.want) || next != tt.next {
+			t.Errorf("%s: ScanMembers = %v, %d, want %v, %d", tt.name, ids, next, tt.want, tt.next)
+		}
+	}
+}
+
+func TestKVTopicStoreScanMembersAll(t *testing.T) {
+	store := NewKVTopicStore(NewMemoryStore())
+	tests := []struct {
+		members int
+		count   int
+	}{
+		{0, 3},
+		{1, 3},
+		{3, 3},
+		{7, 3},
+		{7, 1},
+	}
+	for _, tt := range tests {
+		topicName := "t" + strconv.Itoa(tt.members) + "-" + strconv.Itoa(tt.count)
+		for i := 0; i < tt.members; i++ {
+			store.AddMember(topicName, NewMember(strconv.Itoa(i)))
+		}
+		seen := make(map[string]bool)
+		var cursor uint64
+		for {
+			members, next, err := store.ScanMembers(topicName, cursor, tt.count)
+			if err != nil {
+				t.Fatalf("%s: ScanMembers = %v", topicName, err)
+			}
+			for _, m := range members {
+				if seen[m.ID] {
+					t.Errorf("%s: %s seen twice", topicName, m.ID)
+				}
+				seen[m.ID] = true
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+		if len(seen) != tt.members {
+			t.Errorf("%s: %d members scanned, want %d", topicName, len(seen), tt.members)
+		}
+	}
+}
+
+func TestScanKeys(t *testing.T) {
+	kv := NewMemoryStore()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		kv.Set(KV_SESSION_PREFIX + id, nil, defaultTTL)
+	}
+	kv.Set(KV_TOPIC_PREFIX + "news", nil, defaultTTL)
+	tests := []struct {
+		name   string
+		prefix string
+		cursor uint64
+		count  int
+		want   []string
+		next   uint64
+	}{
+		{"first page", KV_SESSION_PREFIX, 0, 2, []string{"a", "b"}, 2},
+		{"middle page", KV_SESSION_PREFIX, 2, 2, []string{"c", "d"}, 4},
+		{"last page", KV_SESSION_PREFIX, 4, 2, []string{"e"}, 0},
+		{"all in one", KV_SESSION_PREFIX, 0, 5, []string{"a", "b", "c", "d", "e"}, 0},
+		{"past the end", KV_SESSION_PREFIX, 5, 2, []string{}, 0},
+		{"other prefix", KV_TOPIC_PREFIX, 0, 2, []string{"news"}, 0},
+		{"no keys", KV_HOST_TOPICS_PREFIX, 0, 2, []string{}, 0},
+	}
+	for _, tt := range tests {
+		ids, next, err := scanKeys(kv, tt.prefix, tt.cursor, tt.count)
+		if err != nil || !reflect.DeepEqual(ids, tt.want) || next != tt.next {
+			t.Errorf("%s: scanKeys = %v, %d, %v, want %v, %d", tt.name, ids, next, err, tt.want, tt.next)
+		}
+	}
+}
+
+func TestKVTopicStoreGetHosts(t *testing.T) {
+	store := NewKVTopicStore(NewMemoryStore())
+	store.AddHostTopic("ms1", "news")
+	store.AddHostTopic("ms1", "sport")
+	store.AddHostTopic("ms2", "tech")
+	store.AddHostTopic("ms3", "art")
+	store.RemoveHostTopic("ms3", "art")
+	hosts, err := store.GetHosts()
+	if err != nil || !reflect.DeepEqual(hosts, []string{"ms1", "ms2"}) {
+		t.Errorf("GetHosts = %v, %v, want [ms1 ms2]", hosts, err)
+	}
+}
+
+func TestKVTopicStoreMoveTopic(t *testing.T) {
+	store := NewKVTopicStore(NewMemoryStore())
+	store.Set(NewTopicStoreData("news", "alice", "ms1"))
+	store.AddHostTopic("ms1", "news")
+	tests := []struct {
+		name  string
+		topic string
+		from  string
+		to    string
+		moved bool
+		host  string
+	}{
+		{"held by from", "news", "ms1", "ms2", true, "ms2"},
+		{"moved already", "news", "ms1", "ms3", false, "ms2"},
+		{"no topic", "sport", "ms1", "ms2", false, ""},
+	}
+	for _, tt := range tests {
+		moved, err := store.MoveTopic(tt.topic, tt.from, tt.to)
+		if err != nil || moved != tt.moved {
+			t.Errorf("%s: MoveTopic = %v, %v, want %v", tt.name, moved, err, tt.moved)
+		}
+		if tt.host == "" {
+			continue
+		}
+		tsd, err := store.Get(tt.topic)
+		if err != nil || tsd.MsgServerAddr != tt.host {
+			t.Errorf("%s: topic is held by %v, %v, want %s", tt.name, tsd, err, tt.host)
+		}
+	}
+	hosts, _ := store.GetHosts()
+	if !reflect.DeepEqual(hosts, []string{"ms2"}) {
+		t.Errorf("GetHosts = %v, want [ms2]", hosts)
+	}
+}
@@ -0,0 +1,121 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"strings"
+)
+
+type memoryEntry struct {
+	value    []byte
+	expireAt time.Time
+}
+
+// MemoryStore is a KVStore in the memory of the process. It is not shared
+// with other processes, so it suits tests and single node setups.
+type MemoryStore struct {
+	rwMutex  sync.RWMutex
+	values   map[string]*memoryEntry
+	sets     map[string]map[string]bool
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore {
+		values : make(map[string]*memoryEntry),
+		sets   : make(map[string]map[string]bool),
+	}
+}
+
+func (self *MemoryStore) Get(key string) ([]byte, error) {
+	self.rwMutex.RLock()
+	defer self.rwMutex.RUnlock()
+	e := self.values[key]
+	if e == nil || time.Now().After(e.expireAt) {
+		return nil, ErrNotFound
+	}
+	return append([]byte {}, e.value...), nil
+}
+
+func (self *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	self.rwMutex.Lock()
+	defer self.rwMutex.Unlock()
+	self.values[key] = &memoryEntry {
+		value    : append([]byte {}, value...),
+		expireAt : time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (self *MemoryStore) Delete(key string) error {
+	self.rwMutex.Lock()
+	defer self.rwMutex.Unlock()
+	delete(self.values, key)
+	delete(self.sets, key)
+	return nil
+}
+
+// Get the keys which start with prefix. Expired keys are dropped on the way.
+func (self *MemoryStore) Keys(prefix string) ([]string, error) {
+	self.rwMutex.Lock()
+	defer self.rwMutex.Unlock()
+	now := time.Now()
+	keys := make([]string, 0)
+	for k, e := range self.values {
+		if now.After(e.expireAt) {
+			delete(self.values, k)
+			continue
+		}
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (self *MemoryStore) SAdd(key string, member string) error {
+	self.rwMutex.Lock()
+	defer self.rwMutex.Unlock()
+	if self.sets[key] == nil {
+		self.sets[key] = make(map[string]bool)
+	}
+	self.sets[key][member] = true
+	return nil
+}
+
+func (self *MemoryStore) SRem(key string, member string) error {
+	self.rwMutex.Lock()
+	defer self.rwMutex.Unlock()
+	delete(self.sets[key], member)
+	if len(self.sets[key]) == 0 {
+		delete(self.sets, key)
+	}
+	return nil
+}
+
+func (self *MemoryStore) SMembers(key string) ([]string, error) {
+	self.rwMutex.RLock()
+	defer self.rwMutex.RUnlock()
+	members := make([]string, 0, len(self.sets[key]))
+	for m := range self.sets[key] {
+		members = append(members, m)
+	}
+	sort.Strings(members)
+	return members, nil
+}
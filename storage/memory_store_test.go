@@ -0,0 +1,207 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryStoreGetSet(t *testing.T) {
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		ttl   time.Duration
+		err   error
+	}{
+		{"set", "a", "1", time.Minute, nil},
+		{"empty value", "b", "", time.Minute, nil},
+		{"expired", "c", "3", -time.Second, ErrNotFound},
+	}
+	kv := NewMemoryStore()
+	for _, tt := range tests {
+		err := kv.Set(tt.key, []byte(tt.value), tt.ttl)
+		if err != nil {
+			t.Fatalf("%s: Set = %v", tt.name, err)
+		}
+		b, err := kv.Get(tt.key)
+		if err != tt.err {
+			t.Errorf("%s: Get error = %v, want %v", tt.name, err, tt.err)
+		}
+		if err == nil && string(b) != tt.value {
+			t.Errorf("%s: Get = %q, want %q", tt.name, b, tt.value)
+		}
+	}
+	
+	kv.Delete("a")
+	if _, err := kv.Get("a"); err != ErrNotFound {
+		t.Errorf("Get after Delete = %v, want %v", err, ErrNotFound)
+	}
+	if _, err := kv.Get("missing"); err != ErrNotFound {
+		t.Errorf("Get missing = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestMemoryStoreKeys(t *testing.T) {
+	kv := NewMemoryStore()
+	kv.Set("session:b", nil, time.Minute)
+	kv.Set("session:a", nil, time.Minute)
+	kv.Set("session:old", nil, -time.Second)
+	kv.Set("topic:a", nil, time.Minute)
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"session:", []string{"session:a", "session:b"}},
+		{"topic:", []string{"topic:a"}},
+		{"none:", []string{}},
+		{"", []string{"session:a", "session:b", "topic:a"}},
+	}
+	for _, tt := range tests {
+		keys, err := kv.Keys(tt.prefix)
+		if err != nil || !reflect.DeepEqual(keys, tt.want) {
+			t.Errorf("Keys(%q) = %v, %v, want %v", tt.prefix, keys, err, tt.want)
+		}
+	}
+}
+
+func TestMemoryStoreSets(t *testing.T) {
+	tests := []struct {
+		name string
+		add  []string
+		rem  []string
+		want []string
+	}{
+		{"empty", nil, nil, []string{}},
+		{"sorted", []string{"c", "a", "b"}, nil, []string{"a", "b", "c"}},
+		{"no duplicates", []string{"a", "a"}, nil, []string{"a"}},
+		{"removed", []string{"a", "b"}, []string{"a", "x"}, []string{"b"}},
+		{"all removed", []string{"a"}, []string{"a"}, []string{}},
+	}
+	for _, tt := range tests {
+		kv := NewMemoryStore()
+		for _, m := range tt.add {
+			kv.SAdd("set", m)
+		}
+		for _, m := range tt.rem {
+			kv.SRem("set", m)
+		}
+		members, err := kv.SMembers("set")
+		if err != nil || !reflect.DeepEqual(members, tt.want) {
+			t.Errorf("%s: SMembers = %v, %v, want %v", tt.name, members, err, tt.want)
+		}
+	}
+}
+
+func TestKVSessionStore(t *testing.T) {
+	store := NewKVSessionStore(NewMemoryStore())
+	tests := []struct {
+		clientID      string
+		msgServerAddr string
+	}{
+		{"alice", "127.0.0.1:19000"},
+		{"bob", "127.0.0.1:19001"},
+	}
+	for _, tt := range tests {
+		err := store.Set(NewSessionStoreData(tt.clientID, "client", tt.msgServerAddr, "1"))
+		if err != nil {
+			t.Fatalf("%s: Set = %v", tt.clientID, err)
+		}
+		sess, err := store.Get(tt.clientID)
+		if err != nil || sess.ClientID != tt.clientID || sess.MsgServerAddr != tt.msgServerAddr {
+			t.Errorf("%s: Get = %+v, %v", tt.clientID, sess, err)
+		}
+	}
+	if n := store.Len(); n != len(tests) {
+		t.Errorf("Len = %d, want %d", n, len(tests))
+	}
+	
+	store.Delete("alice")
+	if _, err := store.Get("alice"); err != ErrNotFound {
+		t.Errorf("Get after Delete = %v, want %v", err, ErrNotFound)
+	}
+	store.Clear()
+	if n := store.Len(); n != 0 {
+		t.Errorf("Len after Clear = %d, want 0", n)
+	}
+}
+
+func TestKVTopicStore(t *testing.T) {
+	store := NewKVTopicStore(NewMemoryStore())
+	tsd := NewTopicStoreData("news", "alice", "127.0.0.1:19000")
+	err := store.Set(tsd)
+	if err != nil {
+		t.Fatalf("Set = %v", err)
+	}
+	
+	tests := []struct {
+		id   string
+		role string
+	}{
+		{"alice", TOPIC_ROLE_OWNER},
+		{"bob", TOPIC_ROLE_SUBSCRIBER},
+	}
+	for _, tt := range tests {
+		m := NewMember(tt.id)
+		m.Role = tt.role
+		err = store.AddMember("news", m)
+		if err != nil {
+			t.Fatalf("%s: AddMember = %v", tt.id, err)
+		}
+		got, err := store.GetMember("news", tt.id)
+		if err != nil || got == nil || got.Role != tt.role {
+			t.Errorf("%s: GetMember = %+v, %v", tt.id, got, err)
+		}
+	}
+	
+	got, err := store.Get("news")
+	if err != nil || got.CreaterID != "alice" || len(got.MemberList) != 0 {
+		t.Errorf("Get = %+v, %v", got, err)
+	}
+	if n, _ := store.CountMembers("news"); n != len(tests) {
+		t.Errorf("CountMembers = %d, want %d", n, len(tests))
+	}
+	
+	store.RemoveMember("news", "bob")
+	if ok, _ := store.IsMember("news", "bob"); ok {
+		t.Errorf("bob is still a member")
+	}
+	if m, _ := store.GetMember("news", "bob"); m != nil {
+		t.Errorf("GetMember of removed member = %+v", m)
+	}
+	
+	store.Delete("news")
+	if _, err := store.Get("news"); err != ErrNotFound {
+		t.Errorf("Get after Delete = %v, want %v", err, ErrNotFound)
+	}
+	if n, _ := store.CountMembers("news"); n != 0 {
+		t.Errorf("CountMembers after Delete = %d, want 0", n)
+	}
+}
+
+func TestNewStoresMemoryBackend(t *testing.T) {
+	opts := &BackendOptions {
+		Backend : BACKEND_MEMORY,
+	}
+	// every store of the memory backend sees the same data
+	NewSessionStore(opts).Set(NewSessionStoreData("alice", "client", "127.0.0.1:19000", "1"))
+	sess, err := NewSessionStore(opts).Get("alice")
+	if err != nil || sess.ClientID != "alice" {
+		t.Errorf("Get = %+v, %v", sess, err)
+	}
+}
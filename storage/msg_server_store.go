@@ -0,0 +1,152 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+)
+
+// MsgServerStore is the registry of the running msg_servers. Each msg_server
+// refreshes its own record before the TTL runs out, so a dead msg_server
+// drops out of the registry by itself.
+type MsgServerStore struct {
+	RS       *RedisStore
+}
+
+func NewMsgServerStore(RS *RedisStore) *MsgServerStore {
+	return &MsgServerStore {
+		RS    : RS,
+	}
+}
+
+type MsgServerStoreData struct {
+	MsgServerAddr string
+	WsAddr        string
+	HealthAddr    string
+	InternalAddr  string
+	SessionNum    int
+	TopicNum      int
+	Weight        int
+	UpdateTime    int64
+}
+
+func NewMsgServerStoreData(MsgServerAddr string, SessionNum int, TopicNum int, Weight int) *MsgServerStoreData {
+	return &MsgServerStoreData {
+		MsgServerAddr : MsgServerAddr,
+		SessionNum    : SessionNum,
+		TopicNum      : TopicNum,
+		Weight        : Weight,
+		UpdateTime    : time.Now().Unix(),
+	}
+}
+
+// PeerAddr is where routers and managers link to the msg_server.
+func (self *MsgServerStoreData)PeerAddr() string {
+	if self.InternalAddr != "" {
+		return self.InternalAddr
+	}
+	return self.MsgServerAddr
+}
+
+func (self *MsgServerStoreData)StoreKey() string {
+	return self.MsgServerAddr
+}
+
+func (self *MsgServerStore)key(addr string) string {
+	return self.RS.Key(NS_MSG_SERVER, addr)
+}
+
+func (self *MsgServerStore)listKey() string {
+	return self.RS.Key(NS_MSG_SERVERS)
+}
+
+// Register or refresh the msg_server record, it expires after ttl.
+func (self *MsgServerStore) Set(ms *MsgServerStoreData, ttl time.Duration) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	b, err := json.Marshal(ms)
+	if err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	conn.Send("SADD", self.listKey(), ms.MsgServerAddr)
+	conn.Send("SETEX", self.key(ms.MsgServerAddr), int(ttl.Seconds()), b)
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the msg_server record from the store.
+func (self *MsgServerStore) Get(addr string) (*MsgServerStoreData, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	b, err := redis.Bytes(conn.Do("GET", self.key(addr)))
+	if err != nil {
+		return nil, err
+	}
+	var ms MsgServerStoreData
+	err = json.Unmarshal(b, &ms)
+	if err != nil {
+		return nil, err
+	}
+	return &ms, nil
+}
+
+// Delete the msg_server from the registry.
+func (self *MsgServerStore) Delete(addr string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SREM", self.listKey(), addr)
+	conn.Send("DEL", self.key(addr))
+	_, err := conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// List all the live msg_servers. Expired records are removed from the registry.
+func (self *MsgServerStore) List() ([]*MsgServerStoreData, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	addrs, err := redis.Strings(conn.Do("SMEMBERS", self.listKey()))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*MsgServerStoreData, 0)
+	for _, addr := range addrs {
+		b, err := redis.Bytes(conn.Do("GET", self.key(addr)))
+		if err == redis.ErrNil {
+			conn.Do("SREM", self.listKey(), addr)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var ms MsgServerStoreData
+		err = json.Unmarshal(b, &ms)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, &ms)
+	}
+	return list, nil
+}
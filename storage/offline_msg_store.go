@@ -0,0 +1,141 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+)
+
+type OfflineMsgStore struct {
+	RS       *RedisStore
+}
+
+func NewOfflineMsgStore(RS *RedisStore) *OfflineMsgStore {
+	return &OfflineMsgStore {
+		RS    : RS,
+	}
+}
+
+// OfflineMsgData is a P2P message, or a topic message if TopicName is set.
+type OfflineMsgData struct {
+	MsgID      string
+	ClientID   string
+	FromID     string
+	Msg        string
+	TopicName  string
+	CreateTime int64
+	raw        []byte // the stored entry, for Remove
+}
+
+func NewOfflineMsgData(MsgID string, ClientID string, FromID string, Msg string) *OfflineMsgData {
+	return &OfflineMsgData {
+		MsgID      : MsgID,
+		ClientID   : ClientID,
+		FromID     : FromID,
+		Msg        : Msg,
+		CreateTime : time.Now().Unix(),
+	}
+}
+
+func (self *OfflineMsgData)StoreKey() string {
+	return self.ClientID
+}
+
+func (self *OfflineMsgStore)key(id string) string {
+	return self.RS.Key(NS_INBOX, id)
+}
+
+// Append the message to the inbox of msg.ClientID. The inbox keeps at most
+// maxCount messages (the oldest are dropped) and expires ttl after the last push.
+func (self *OfflineMsgStore) Push(msg *OfflineMsgData, ttl time.Duration, maxCount int) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	key := self.key(msg.ClientID)
+	if ttl == 0 {
+		ttl = 7 * 24 * time.Hour // Default to 7 days
+	}
+	conn.Send("MULTI")
+	conn.Send("RPUSH", key, b)
+	if maxCount > 0 {
+		conn.Send("LTRIM", key, -maxCount, -1)
+	}
+	conn.Send("EXPIRE", key, int(ttl.Seconds()))
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the messages in the inbox of id, oldest first, without removing them.
+// Each message is removed by Remove once it is delivered. Messages older
+// than ttl are removed on the way.
+func (self *OfflineMsgStore) Peek(id string, ttl time.Duration) ([]*OfflineMsgData, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	key := self.key(id)
+	vals, err := redis.ByteSlices(conn.Do("LRANGE", key, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*OfflineMsgData, 0)
+	now := time.Now().Unix()
+	for _, b := range vals {
+		var msg OfflineMsgData
+		err = json.Unmarshal(b, &msg)
+		if err != nil {
+			return nil, err
+		}
+		msg.raw = b
+		if ttl != 0 && now - msg.CreateTime > int64(ttl.Seconds()) {
+			err = self.Remove(&msg)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
+
+// Remove a message got by Peek from the inbox.
+func (self *OfflineMsgStore) Remove(msg *OfflineMsgData) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := conn.Do("LREM", self.key(msg.ClientID), 1, msg.raw)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the number of messages waiting in the inbox of id.
+func (self *OfflineMsgStore) Len(id string) int {
+	conn := self.RS.Get()
+	defer conn.Close()
+	n, err := redis.Int(conn.Do("LLEN", self.key(id)))
+	if err != nil {
+		return -1
+	}
+	return n
+}
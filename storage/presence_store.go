@@ -0,0 +1,122 @@
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+)
+
+type PresenceStore struct {
+	RS       *RedisStore
+}
+
+func NewPresenceStore(RS *RedisStore) *PresenceStore {
+	return &PresenceStore {
+		RS    : RS,
+	}
+}
+
+type PresenceData struct {
+	ClientID      string
+	State         string
+	Status        string
+	MsgServerAddr string
+	UpdateTime    int64
+}
+
+func NewPresenceData(ClientID string, State string, Status string, MsgServerAddr string) *PresenceData {
+	return &PresenceData {
+		ClientID      : ClientID,
+		State         : State,
+		Status        : Status,
+		MsgServerAddr : MsgServerAddr,
+		UpdateTime    : time.Now().Unix(),
+	}
+}
+
+func (self *PresenceData)StoreKey() string {
+	return self.ClientID
+}
+
+func (self *PresenceStore)key(id string) string {
+	return self.RS.Key(NS_PRESENCE, id)
+}
+
+func (self *PresenceStore)subscribersKey(id string) string {
+	return self.RS.Key(NS_PRESENCE_SUBS, id)
+}
+
+// Get the presence of id.
+func (self *PresenceStore) Get(id string) (*PresenceData, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	b, err := redis.Bytes(conn.Do("GET", self.key(id)))
+	if err != nil {
+		return nil, err
+	}
+	var p PresenceData
+	err = json.Unmarshal(b, &p)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Save the presence of p.ClientID.
+func (self *PresenceStore) Set(p *PresenceData) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Do("SET", self.key(p.ClientID), b)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Subscribe subscriberID to the presence changes of id.
+func (self *PresenceStore) AddSubscriber(id string, subscriberID string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := conn.Do("SADD", self.subscribersKey(id), subscriberID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Unsubscribe subscriberID from the presence changes of id.
+func (self *PresenceStore) RemoveSubscriber(id string, subscriberID string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := conn.Do("SREM", self.subscribersKey(id), subscriberID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the clients subscribed to the presence changes of id.
+func (self *PresenceStore) GetSubscribers(id string) ([]string, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", self.subscribersKey(id)))
+}
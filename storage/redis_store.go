@@ -17,15 +17,45 @@ package storage
 
 import (
 	"time"
-	"sync"
-	"errors"
+	"strings"
 	"github.com/garyburd/redigo/redis"
 )
 
-var (
-	ErrNoKeyPrefix = errors.New("cannot get session keys without a key prefix")
+// Namespaces of the Redis keys. A key is KeyPrefix:namespace:id, so records
+// of different types never share a key.
+const (
+	NS_SESSION           = "session"
+	NS_TOPIC             = "topic"
+	NS_TOPIC_MEMBERS     = "topicmembers"
+	NS_TOPIC_MEMBER_INFO = "topicmemberinfo"
+	NS_INBOX             = "inbox"
+	NS_PRESENCE          = "presence"
+	NS_PRESENCE_SUBS     = "presencesubs"
+	NS_CLIENT_TOPICS     = "mytopics"
+	NS_HOST_TOPICS       = "hosttopics"
+	NS_TOPIC_HOSTS       = "topichosts"
+	NS_HOST_SESSIONS     = "hostsessions"
+	NS_MSG_SERVER        = "msgserver"
+	NS_MSG_SERVERS       = "msgservers"
 )
 
+// All the namespaces, for tools that walk the keys.
+var Namespaces = []string {
+	NS_SESSION,
+	NS_TOPIC,
+	NS_TOPIC_MEMBERS,
+	NS_TOPIC_MEMBER_INFO,
+	NS_INBOX,
+	NS_PRESENCE,
+	NS_PRESENCE_SUBS,
+	NS_CLIENT_TOPICS,
+	NS_HOST_TOPICS,
+	NS_TOPIC_HOSTS,
+	NS_HOST_SESSIONS,
+	NS_MSG_SERVER,
+	NS_MSG_SERVERS,
+}
+
 type RedisStoreOptions struct {
 	Network              string
 	Address              string
@@ -35,25 +65,103 @@ type RedisStoreOptions struct {
 	Database             int           // Redis database to use for session keys
 	KeyPrefix            string        // If set, keys will be KeyPrefix:SessionID (semicolon added)
 	BrowserSessServerTTL time.Duration // Defaults to 2 days
+	MaxIdle              int           // Idle connections kept in the pool, defaults to 8
+	MaxActive            int           // Connections open at once, 0 for no limit
+	IdleTimeout          time.Duration // Idle connections are closed after it, defaults to 4 minutes
 }
 
+// RedisStore is a pool of connections to Redis. The stores of a process share
+// one RedisStore. Broken connections are dropped by the pool and dialed again
+// on the next Get, so Redis going away for a while is not fatal.
 type RedisStore struct {
 	opts        *RedisStoreOptions
-	conn        redis.Conn
-	rwMutex     sync.Mutex
+	pool        *redis.Pool
 }
 
-// Create a redis session store with the specified options.
+// Create a redis store with the specified options. Connections are dialed
+// when they are needed.
 func NewRedisStore(opts *RedisStoreOptions) *RedisStore {
-	var err error
-	rs := &RedisStore{
-		opts : opts, 
-		conn : nil,
-		}
-	rs.conn, err = redis.DialTimeout(opts.Network, opts.Address, opts.ConnectTimeout,
-		opts.ReadTimeout, opts.WriteTimeout)
+	maxIdle := opts.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = 8
+	}
+	idleTimeout := opts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 4 * time.Minute
+	}
+	return &RedisStore {
+		opts : opts,
+		pool : &redis.Pool {
+			MaxIdle     : maxIdle,
+			MaxActive   : opts.MaxActive,
+			IdleTimeout : idleTimeout,
+			Wait        : true,
+			Dial        : func() (redis.Conn, error) {
+				return redis.DialTimeout(opts.Network, opts.Address, opts.ConnectTimeout,
+					opts.ReadTimeout, opts.WriteTimeout)
+			},
+			TestOnBorrow : func(c redis.Conn, t time.Time) error {
+				if time.Since(t) < time.Minute {
+					return nil
+				}
+				_, err := c.Do("PING")
+				return err
+			},
+		},
+	}
+}
+
+// Get a connection from the pool. It must be closed after use to go back
+// to the pool.
+func (self *RedisStore) Get() redis.Conn {
+	return self.pool.Get()
+}
+
+// Build a key from its namespace and parts, behind the key prefix.
+func (self *RedisStore) Key(parts ...string) string {
+	key := strings.Join(parts, ":")
+	if self.opts.KeyPrefix != "" {
+		key = self.opts.KeyPrefix + ":" + key
+	}
+	return key
+}
+
+// Get the key prefix, with the trailing colon.
+func (self *RedisStore) Prefix() string {
+	if self.opts.KeyPrefix != "" {
+		return self.opts.KeyPrefix + ":"
+	}
+	return ""
+}
+
+// Get a page of about count ids in the namespace ns, starting at cursor. It
+// uses SCAN, which unlike KEYS never blocks Redis for long. The first page
+// starts at cursor 0, and the next cursor is 0 after the last page. An id
+// may show up on more than one page.
+func (self *RedisStore) ScanKeys(ns string, cursor uint64, count int) ([]string, uint64, error) {
+	conn := self.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", self.Key(ns, "*"), "COUNT", count))
+	if err != nil {
+		return nil, 0, err
+	}
+	next, err := redis.Uint64(reply[0], nil)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
-	return rs
+	keys, err := redis.Strings(reply[1], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	prefix := self.Key(ns, "")
+	ids := make([]string, 0, len(keys))
+	for _, k := range keys {
+		ids = append(ids, strings.TrimPrefix(k, prefix))
+	}
+	return ids, next, nil
+}
+
+// Close the pool.
+func (self *RedisStore) Close() error {
+	return self.pool.Close()
 }
@@ -1,162 +1,233 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package storage
-
-import (
-	"sync"
-	"time"
-	"encoding/json"
-	"github.com/garyburd/redigo/redis"
-)
-
-type SessionStore struct {
-	RS       *RedisStore
-	rwMutex  sync.Mutex
-}
-
-func NewSessionStore(RS *RedisStore) *SessionStore {
-	return &SessionStore {
-		RS    : RS,
-	}
-}
-
-type SessionStoreData struct {
-	ClientID      string
-	ClientAddr    string
-	MsgServerAddr string
-	ID            string
-	MaxAge        time.Duration
-}
-
-func NewSessionStoreData(ClientID string, ClientAddr string, MsgServerAddr string, ID string) *SessionStoreData {
-	return &SessionStoreData {
-		ClientID      : ClientID,
-		ClientAddr    : ClientAddr,
-		MsgServerAddr : MsgServerAddr,
-		ID            : ID,
-	}
-}
-
-func (self *SessionStoreData)checkClientID(clientID string) bool {
-	return true
-}
-
-func (self *SessionStoreData)StoreKey() string {
-	return self.ClientID
-}
-
-// Get the session from the store.
-func (self *SessionStore) Get(k string) (*SessionStoreData, error) {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	key := k
-	if self.RS.opts.KeyPrefix != "" {
-		key = self.RS.opts.KeyPrefix + ":" + k
-	}
-	b, err := redis.Bytes(self.RS.conn.Do("GET", key))
-	if err != nil {
-		return nil, err
-	}
-	var sess SessionStoreData
-	err = json.Unmarshal(b, &sess)
-	if err != nil {
-		return nil, err
-	}
-	return &sess, nil
-}
-
-// Save the session into the store.
-func (self *SessionStore) Set(sess *SessionStoreData) error {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	b, err := json.Marshal(sess)
-	if err != nil {
-		return err
-	}
-	key := sess.ClientID
-	if self.RS.opts.KeyPrefix != "" {
-		key = self.RS.opts.KeyPrefix + ":" + sess.ClientID
-	}
-	ttl := sess.MaxAge
-	if ttl == 0 {
-		// Browser session, set to specified TTL
-		ttl = self.RS.opts.BrowserSessServerTTL
-		if ttl == 0 {
-			ttl = 2 * 24 * time.Hour // Default to 2 days
-		}
-	}
-	_, err = self.RS.conn.Do("SETEX", key, int(ttl.Seconds()), b)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Delete the session from the store.
-func (self *SessionStore) Delete(id string) error {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	key := id
-	if self.RS.opts.KeyPrefix != "" {
-		key = self.RS.opts.KeyPrefix + ":" + id
-	}
-	_, err := self.RS.conn.Do("DEL", key)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-// Clear all sessions from the store. Requires the use of a key
-// prefix in the store options, otherwise the method refuses to delete all keys.
-func (self *SessionStore) Clear() error {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	vals, err := self.getSessionKeys()
-	if err != nil {
-		return err
-	}
-	if len(vals) > 0 {
-		self.RS.conn.Send("MULTI")
-		for _, v := range vals {
-			self.RS.conn.Send("DEL", v)
-		}
-		_, err = self.RS.conn.Do("EXEC")
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-// Get the number of session keys in the store. Requires the use of a
-// key prefix in the store options, otherwise returns -1 (cannot tell
-// session keys from other keys).
-func (self *SessionStore) Len() int {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	vals, err := self.getSessionKeys()
-	if err != nil {
-		return -1
-	}
-	return len(vals)
-}
-func (self *SessionStore) getSessionKeys() ([]interface{}, error) {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	if self.RS.opts.KeyPrefix != "" {
-		return redis.Values(self.RS.conn.Do("KEYS", self.RS.opts.KeyPrefix+":*"))
-	}
-	return nil, ErrNoKeyPrefix
-}
\ No newline at end of file
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisSessionStore is the SessionStore on Redis.
+type RedisSessionStore struct {
+	RS       *RedisStore
+}
+
+func NewRedisSessionStore(RS *RedisStore) *RedisSessionStore {
+	return &RedisSessionStore {
+		RS    : RS,
+	}
+}
+
+type SessionStoreData struct {
+	ClientID      string
+	ClientAddr    string
+	MsgServerAddr string
+	ID            string
+	DeviceList    []*Device
+	MaxAge        time.Duration
+}
+
+// Device is one session of a client. ID is the session id on MsgServerAddr.
+type Device struct {
+	ID            string
+	ClientAddr    string
+	MsgServerAddr string
+}
+
+func NewSessionStoreData(ClientID string, ClientAddr string, MsgServerAddr string, ID string) *SessionStoreData {
+	return &SessionStoreData {
+		ClientID      : ClientID,
+		ClientAddr    : ClientAddr,
+		MsgServerAddr : MsgServerAddr,
+		ID            : ID,
+		DeviceList    : []*Device {
+			&Device {
+				ID            : ID,
+				ClientAddr    : ClientAddr,
+				MsgServerAddr : MsgServerAddr,
+			},
+		},
+	}
+}
+
+// Add the devices of sess, replacing the ones with the same id. sess becomes
+// the latest session of the client.
+func (self *SessionStoreData)MergeDevices(sess *SessionStoreData) {
+	for _, d := range sess.DeviceList {
+		self.RemoveDevice(d.ID, d.MsgServerAddr)
+		self.DeviceList = append(self.DeviceList, d)
+	}
+	self.ClientAddr = sess.ClientAddr
+	self.MsgServerAddr = sess.MsgServerAddr
+	self.ID = sess.ID
+}
+
+// Remove a device. If it was the latest session of the client, the last
+// device left takes its place.
+func (self *SessionStoreData)RemoveDevice(id string, msgServerAddr string) {
+	for i, d := range self.DeviceList {
+		if d.ID == id && d.MsgServerAddr == msgServerAddr {
+			self.DeviceList = append(self.DeviceList[:i], self.DeviceList[i+1:]...)
+			break
+		}
+	}
+	if self.ID == id && self.MsgServerAddr == msgServerAddr && len(self.DeviceList) > 0 {
+		last := self.DeviceList[len(self.DeviceList) - 1]
+		self.ClientAddr = last.ClientAddr
+		self.MsgServerAddr = last.MsgServerAddr
+		self.ID = last.ID
+	}
+}
+
+// Get the msg_servers the client is connected to.
+func (self *SessionStoreData)MsgServerAddrs() []string {
+	addrs := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, d := range self.DeviceList {
+		if !seen[d.MsgServerAddr] {
+			seen[d.MsgServerAddr] = true
+			addrs = append(addrs, d.MsgServerAddr)
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, self.MsgServerAddr)
+	}
+	return addrs
+}
+
+func (self *SessionStoreData)checkClientID(clientID string) bool {
+	return true
+}
+
+func (self *SessionStoreData)StoreKey() string {
+	return self.ClientID
+}
+
+// Get the session from the store.
+func (self *RedisSessionStore) Get(k string) (*SessionStoreData, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	key := self.RS.Key(NS_SESSION, k)
+	b, err := redis.Bytes(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sess SessionStoreData
+	err = json.Unmarshal(b, &sess)
+	if err != nil {
+		return nil, err
+	}
+	return &sess, nil
+}
+
+// Save the session into the store.
+func (self *RedisSessionStore) Set(sess *SessionStoreData) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	b, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	key := self.RS.Key(NS_SESSION, sess.ClientID)
+	ttl := sess.MaxAge
+	if ttl == 0 {
+		// Browser session, set to specified TTL
+		ttl = self.RS.opts.BrowserSessServerTTL
+		if ttl == 0 {
+			ttl = 2 * 24 * time.Hour // Default to 2 days
+		}
+	}
+	_, err = conn.Do("SETEX", key, int(ttl.Seconds()), b)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Delete the session from the store.
+func (self *RedisSessionStore) Delete(id string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	key := self.RS.Key(NS_SESSION, id)
+	_, err := conn.Do("DEL", key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get a page of about count client IDs, starting at cursor. See
+// RedisStore.ScanKeys.
+func (self *RedisSessionStore) Scan(cursor uint64, count int) ([]string, uint64, error) {
+	return self.RS.ScanKeys(NS_SESSION, cursor, count)
+}
+
+// Clear all sessions from the store, a page at a time.
+func (self *RedisSessionStore) Clear() error {
+	// Scan borrows a connection of its own, so one is only held per page
+	return ScanEach(self.Scan, DEFAULT_SCAN_COUNT, func(ids []string) error {
+		conn := self.RS.Get()
+		defer conn.Close()
+		args := redis.Args{}
+		for _, id := range ids {
+			args = args.Add(self.RS.Key(NS_SESSION, id))
+		}
+		_, err := conn.Do("DEL", args...)
+		return err
+	})
+}
+
+// Get the number of sessions in the store, or -1 on error.
+func (self *RedisSessionStore) Len() int {
+	return scanLen(self.Scan)
+}
+
+func (self *RedisSessionStore)hostSessionsKey(msgServerAddr string) string {
+	return self.RS.Key(NS_HOST_SESSIONS, msgServerAddr)
+}
+
+// Record that clientID has a session on the msg_server msgServerAddr.
+func (self *RedisSessionStore) AddHostSession(msgServerAddr string, clientID string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := conn.Do("SADD", self.hostSessionsKey(msgServerAddr), clientID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Record that clientID no longer has a session on the msg_server msgServerAddr.
+func (self *RedisSessionStore) RemoveHostSession(msgServerAddr string, clientID string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := conn.Do("SREM", self.hostSessionsKey(msgServerAddr), clientID)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the client IDs with a session on the msg_server msgServerAddr.
+func (self *RedisSessionStore) GetHostSessions(msgServerAddr string) ([]string, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", self.hostSessionsKey(msgServerAddr)))
+}
@@ -1,173 +1,644 @@
-//
-// Copyright 2014 Hong Miao. All Rights Reserved.
-//
-// Licensed under the Apache License, Version 2.0 (the "License");
-// you may not use this file except in compliance with the License.
-// You may obtain a copy of the License at
-//
-// http://www.apache.org/licenses/LICENSE-2.0
-//
-// Unless required by applicable law or agreed to in writing, software
-// distributed under the License is distributed on an "AS IS" BASIS,
-// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-// See the License for the specific language governing permissions and
-// limitations under the License.
-
-package storage
-
-import (
-	"sync"
-	"time"
-	"encoding/json"
-	"github.com/garyburd/redigo/redis"
-)
-
-type TopicStore struct {
-	RS       *RedisStore
-	rwMutex  sync.Mutex
-}
-
-func NewTopicStore(RS *RedisStore) *TopicStore {
-	return &TopicStore {
-		RS    : RS,
-	}
-}
-
-type TopicStoreData struct {
-	TopicName     string
-	CreaterID     string
-	MemberList    []*Member
-	MsgServerAddr string
-	MaxAge        time.Duration
-}
-
-type Member struct {
-	ID   string
-}
-
-func NewMember(ID string) *Member {
-	return &Member {
-		ID : ID,
-	}
-}
-
-func NewTopicStoreData(TopicName string, CreaterID string, MsgServerAddr string) *TopicStoreData {
-	return &TopicStoreData {
-		TopicName     : TopicName,
-		CreaterID     : CreaterID,
-		MemberList    : make([]*Member, 0),
-		MsgServerAddr : MsgServerAddr,
-	}
-}
-
-func (self *TopicStoreData)StoreKey() string {
-	return self.TopicName
-}
-
-func (self *TopicStoreData)AddMember(m *Member) {
-	self.MemberList = append(self.MemberList, m)
-}
-
-// Get the session from the store.
-func (self *TopicStore) Get(k string) (*TopicStoreData, error) {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	key := k
-	if self.RS.opts.KeyPrefix != "" {
-		key = self.RS.opts.KeyPrefix + ":" + k
-	}
-	b, err := redis.Bytes(self.RS.conn.Do("GET", key))
-	if err != nil {
-		return nil, err
-	}
-	var sess TopicStoreData
-	err = json.Unmarshal(b, &sess)
-	if err != nil {
-		return nil, err
-	}
-	return &sess, nil
-}
-
-// Save the session into the store.
-func (self *TopicStore) Set(sess *TopicStoreData) error {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	b, err := json.Marshal(sess)
-	if err != nil {
-		return err
-	}
-	key := sess.TopicName
-	if self.RS.opts.KeyPrefix != "" {
-		key = self.RS.opts.KeyPrefix + ":" + sess.TopicName
-	}
-	ttl := sess.MaxAge
-	if ttl == 0 {
-		// Browser session, set to specified TTL
-		ttl = self.RS.opts.BrowserSessServerTTL
-		if ttl == 0 {
-			ttl = 2 * 24 * time.Hour // Default to 2 days
-		}
-	}
-	_, err = self.RS.conn.Do("SETEX", key, int(ttl.Seconds()), b)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Delete the session from the store.
-func (self *TopicStore) Delete(id string) error {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	key := id
-	if self.RS.opts.KeyPrefix != "" {
-		key = self.RS.opts.KeyPrefix + ":" + id
-	}
-	_, err := self.RS.conn.Do("DEL", key)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// Clear all sessions from the store. Requires the use of a key
-// prefix in the store options, otherwise the method refuses to delete all keys.
-func (self *TopicStore) Clear() error {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	vals, err := self.getSessionKeys()
-	if err != nil {
-		return err
-	}
-	if len(vals) > 0 {
-		self.RS.conn.Send("MULTI")
-		for _, v := range vals {
-			self.RS.conn.Send("DEL", v)
-		}
-		_, err = self.RS.conn.Do("EXEC")
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-// Get the number of session keys in the store. Requires the use of a
-// key prefix in the store options, otherwise returns -1 (cannot tell
-// session keys from other keys).
-func (self *TopicStore) Len() int {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	vals, err := self.getSessionKeys()
-	if err != nil {
-		return -1
-	}
-	return len(vals)
-}
-func (self *TopicStore) getSessionKeys() ([]interface{}, error) {
-	self.rwMutex.Lock()
-	defer self.rwMutex.Unlock()
-	if self.RS.opts.KeyPrefix != "" {
-		return redis.Values(self.RS.conn.Do("KEYS", self.RS.opts.KeyPrefix+":*"))
-	}
-	return nil, ErrNoKeyPrefix
-}
\ No newline at end of file
+//
+// Copyright 2014 Hong Miao. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"time"
+	"strconv"
+	"encoding/json"
+	"github.com/garyburd/redigo/redis"
+)
+
+// RedisTopicStore is the TopicStore on Redis.
+type RedisTopicStore struct {
+	RS       *RedisStore
+}
+
+func NewRedisTopicStore(RS *RedisStore) *RedisTopicStore {
+	return &RedisTopicStore {
+		RS    : RS,
+	}
+}
+
+const (
+	TOPIC_ROLE_OWNER       = "owner"
+	TOPIC_ROLE_ADMIN       = "admin"
+	TOPIC_ROLE_PUBLISHER   = "publisher"
+	TOPIC_ROLE_SUBSCRIBER  = "subscriber"
+)
+
+const (
+	TOPIC_MODE_OPEN      = "open"
+	TOPIC_MODE_INVITE    = "invite"
+	TOPIC_MODE_ANNOUNCE  = "announce"
+)
+
+// TopicStoreData is the metadata of a topic. MemberList holds every member
+// only on the msg_server holding the topic, the stores keep the members in
+// a set of their own.
+type TopicStoreData struct {
+	TopicName     string
+	CreaterID     string
+	MemberList    []*Member
+	MsgServerAddr string
+	Mode          string
+	BanList       []string
+	InviteList    []string
+	PendingList   []string
+	MaxAge        time.Duration
+}
+
+type Member struct {
+	ID            string
+	Role          string
+	MsgServerAddr string
+}
+
+func NewMember(ID string) *Member {
+	return &Member {
+		ID   : ID,
+		Role : TOPIC_ROLE_PUBLISHER,
+	}
+}
+
+func NewTopicStoreData(TopicName string, CreaterID string, MsgServerAddr string) *TopicStoreData {
+	return &TopicStoreData {
+		TopicName     : TopicName,
+		CreaterID     : CreaterID,
+		MemberList    : make([]*Member, 0),
+		MsgServerAddr : MsgServerAddr,
+		Mode          : TOPIC_MODE_OPEN,
+		BanList       : make([]string, 0),
+		InviteList    : make([]string, 0),
+		PendingList   : make([]string, 0),
+	}
+}
+
+func IsTopicRole(role string) bool {
+	switch role {
+		case TOPIC_ROLE_OWNER, TOPIC_ROLE_ADMIN, TOPIC_ROLE_PUBLISHER, TOPIC_ROLE_SUBSCRIBER:
+			return true
+	}
+	return false
+}
+
+func IsTopicMode(mode string) bool {
+	switch mode {
+		case TOPIC_MODE_OPEN, TOPIC_MODE_INVITE, TOPIC_MODE_ANNOUNCE:
+			return true
+	}
+	return false
+}
+
+func containsID(list []string, id string) bool {
+	for _, v := range list {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func removeID(list []string, id string) []string {
+	for i, v := range list {
+		if v == id {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+func (self *TopicStoreData)StoreKey() string {
+	return self.TopicName
+}
+
+func (self *TopicStoreData)AddMember(m *Member) {
+	self.MemberList = append(self.MemberList, m)
+}
+
+func (self *TopicStoreData)HasMember(id string) bool {
+	for _, m := range self.MemberList {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *TopicStoreData)RemoveMember(id string) {
+	for i, m := range self.MemberList {
+		if m.ID == id {
+			self.MemberList = append(self.MemberList[:i], self.MemberList[i+1:]...)
+			return
+		}
+	}
+}
+
+func (self *TopicStoreData)GetMember(id string) *Member {
+	for _, m := range self.MemberList {
+		if m.ID == id {
+			return m
+		}
+	}
+	return nil
+}
+
+// Get the role of id in the topic, or "" if id is not a member. Members
+// stored before roles existed are publishers, and the creater is the owner.
+func (self *TopicStoreData)GetRole(id string) string {
+	m := self.GetMember(id)
+	if m == nil {
+		return ""
+	}
+	if id == self.CreaterID {
+		return TOPIC_ROLE_OWNER
+	}
+	if m.Role == "" {
+		return TOPIC_ROLE_PUBLISHER
+	}
+	return m.Role
+}
+
+func (self *TopicStoreData)IsAdmin(id string) bool {
+	role := self.GetRole(id)
+	return role == TOPIC_ROLE_OWNER || role == TOPIC_ROLE_ADMIN
+}
+
+// Check whether id may publish to the topic in its current mode.
+func (self *TopicStoreData)CanPublish(id string) bool {
+	switch self.GetRole(id) {
+		case TOPIC_ROLE_OWNER, TOPIC_ROLE_ADMIN:
+			return true
+		case TOPIC_ROLE_PUBLISHER:
+			return self.Mode != TOPIC_MODE_ANNOUNCE
+	}
+	return false
+}
+
+func (self *TopicStoreData)IsBanned(id string) bool {
+	return containsID(self.BanList, id)
+}
+
+func (self *TopicStoreData)Ban(id string) {
+	if !containsID(self.BanList, id) {
+		self.BanList = append(self.BanList, id)
+	}
+	self.InviteList = removeID(self.InviteList, id)
+	self.PendingList = removeID(self.PendingList, id)
+}
+
+func (self *TopicStoreData)Unban(id string) {
+	self.BanList = removeID(self.BanList, id)
+}
+
+func (self *TopicStoreData)IsInvited(id string) bool {
+	return containsID(self.InviteList, id)
+}
+
+func (self *TopicStoreData)Invite(id string) {
+	if !containsID(self.InviteList, id) {
+		self.InviteList = append(self.InviteList, id)
+	}
+}
+
+func (self *TopicStoreData)RemoveInvite(id string) {
+	self.InviteList = removeID(self.InviteList, id)
+}
+
+func (self *TopicStoreData)IsPending(id string) bool {
+	return containsID(self.PendingList, id)
+}
+
+func (self *TopicStoreData)AddPending(id string) {
+	if !containsID(self.PendingList, id) {
+		self.PendingList = append(self.PendingList, id)
+	}
+}
+
+func (self *TopicStoreData)RemovePending(id string) {
+	self.PendingList = removeID(self.PendingList, id)
+}
+
+func (self *RedisTopicStore)hostTopicsKey(msgServerAddr string) string {
+	return self.RS.Key(NS_HOST_TOPICS, msgServerAddr)
+}
+
+// The set of the msg_servers which hold topics, so that they are found
+// without a SCAN.
+func (self *RedisTopicStore)hostsKey() string {
+	return self.RS.Key(NS_TOPIC_HOSTS)
+}
+
+// KEYS are the topics of the msg_server ARGV[2] and the hosts, ARGV[1] is the topic.
+var removeHostTopicScript = redis.NewScript(2, `
+redis.call("SREM", KEYS[1], ARGV[1])
+if redis.call("SCARD", KEYS[1]) == 0 then
+	redis.call("SREM", KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// KEYS are the topic, the topics of ARGV[1], the topics of ARGV[2] and the
+// hosts, ARGV[3] is the topic name.
+var moveTopicScript = redis.NewScript(4, `
+if redis.call("HGET", KEYS[1], "MsgServerAddr") ~= ARGV[1] then
+	return 0
+end
+redis.call("HSET", KEYS[1], "MsgServerAddr", ARGV[2])
+redis.call("SREM", KEYS[2], ARGV[3])
+if redis.call("SCARD", KEYS[2]) == 0 then
+	redis.call("SREM", KEYS[4], ARGV[1])
+end
+redis.call("SADD", KEYS[3], ARGV[3])
+redis.call("SADD", KEYS[4], ARGV[2])
+return 1
+`)
+
+// Record that the msg_server msgServerAddr holds topicName.
+func (self *RedisTopicStore) AddHostTopic(msgServerAddr string, topicName string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SADD", self.hostTopicsKey(msgServerAddr), topicName)
+	conn.Send("SADD", self.hostsKey(), msgServerAddr)
+	_, err := conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Record that the msg_server msgServerAddr no longer holds topicName. It
+// leaves the hosts with its last topic.
+func (self *RedisTopicStore) RemoveHostTopic(msgServerAddr string, topicName string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := removeHostTopicScript.Do(conn, self.hostTopicsKey(msgServerAddr), self.hostsKey(), 
+		topicName, msgServerAddr)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the names of the topics the msg_server msgServerAddr holds.
+func (self *RedisTopicStore) GetHostTopics(msgServerAddr string) ([]string, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", self.hostTopicsKey(msgServerAddr)))
+}
+
+// Get the msg_servers which hold topics.
+func (self *RedisTopicStore) GetHosts() ([]string, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", self.hostsKey()))
+}
+
+// Move the topic from the msg_server from to the msg_server to, only if from
+// still holds it. It is a compare and set on MsgServerAddr, so of two moves
+// of the same topic only the first one wins.
+func (self *RedisTopicStore) MoveTopic(topicName string, from string, to string) (bool, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	return redis.Bool(moveTopicScript.Do(conn, self.key(topicName), self.hostTopicsKey(from), 
+		self.hostTopicsKey(to), self.hostsKey(), from, to, topicName))
+}
+
+func (self *RedisTopicStore)clientTopicsKey(clientID string) string {
+	return self.RS.Key(NS_CLIENT_TOPICS, clientID)
+}
+
+// Record that clientID is a member of topicName.
+func (self *RedisTopicStore) AddClientTopic(clientID string, topicName string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := conn.Do("SADD", self.clientTopicsKey(clientID), topicName)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Record that clientID is no longer a member of topicName.
+func (self *RedisTopicStore) RemoveClientTopic(clientID string, topicName string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := conn.Do("SREM", self.clientTopicsKey(clientID), topicName)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get the names of the topics clientID is a member of.
+func (self *RedisTopicStore) GetClientTopics(clientID string) ([]string, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("SMEMBERS", self.clientTopicsKey(clientID)))
+}
+
+// Queue the commands that record the msg_server holding t and the topics of
+// its members on conn, so that they can run in the MULTI of the caller.
+func (self *RedisTopicStore) SendIndexTopic(conn redis.Conn, t *TopicStoreData) {
+	if t.MsgServerAddr != "" {
+		conn.Send("SADD", self.hostTopicsKey(t.MsgServerAddr), t.TopicName)
+		conn.Send("SADD", self.hostsKey(), t.MsgServerAddr)
+	}
+	for _, m := range t.MemberList {
+		conn.Send("SADD", self.clientTopicsKey(m.ID), t.TopicName)
+	}
+}
+
+func (self *RedisTopicStore)key(topicName string) string {
+	return self.RS.Key(NS_TOPIC, topicName)
+}
+
+func (self *RedisTopicStore)membersKey(topicName string) string {
+	return self.RS.Key(NS_TOPIC_MEMBERS, topicName)
+}
+
+func (self *RedisTopicStore)memberInfoKey(topicName string) string {
+	return self.RS.Key(NS_TOPIC_MEMBER_INFO, topicName)
+}
+
+// Get the metadata of the topic from its hash. MemberList is left empty,
+// the members are read with IsMember, GetMember and ScanMembers.
+func (self *RedisTopicStore) Get(k string) (*TopicStoreData, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	fields, err := redis.StringMap(conn.Do("HGETALL", self.key(k)))
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrNotFound
+	}
+	t := NewTopicStoreData(fields["TopicName"], fields["CreaterID"], fields["MsgServerAddr"])
+	t.Mode = fields["Mode"]
+	lists := map[string]*[]string {
+		"BanList"     : &t.BanList,
+		"InviteList"  : &t.InviteList,
+		"PendingList" : &t.PendingList,
+	}
+	for name, list := range lists {
+		if fields[name] == "" {
+			continue
+		}
+		err = json.Unmarshal([]byte(fields[name]), list)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if fields["MaxAge"] != "" {
+		maxAge, err := strconv.ParseInt(fields["MaxAge"], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		t.MaxAge = time.Duration(maxAge)
+	}
+	return t, nil
+}
+
+// The TTL of a topic which lives for maxAge, or the default one.
+func (self *RedisTopicStore)ttl(maxAge time.Duration) time.Duration {
+	if maxAge != 0 {
+		return maxAge
+	}
+	// Browser session, set to specified TTL
+	if self.RS.opts.BrowserSessServerTTL != 0 {
+		return self.RS.opts.BrowserSessServerTTL
+	}
+	return 2 * 24 * time.Hour // Default to 2 days
+}
+
+// Save the metadata of the topic into its hash and renew the TTL of the
+// topic and its members. The members are saved by AddMember and RemoveMember.
+func (self *RedisTopicStore) Set(t *TopicStoreData) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	err := self.SendSet(conn, t)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Queue the commands of Set on conn, so that they can run in the MULTI of
+// the caller.
+func (self *RedisTopicStore) SendSet(conn redis.Conn, t *TopicStoreData) error {
+	banList, err := json.Marshal(t.BanList)
+	if err != nil {
+		return err
+	}
+	inviteList, err := json.Marshal(t.InviteList)
+	if err != nil {
+		return err
+	}
+	pendingList, err := json.Marshal(t.PendingList)
+	if err != nil {
+		return err
+	}
+	ttl := self.ttl(t.MaxAge)
+	conn.Send("HMSET", self.key(t.TopicName), 
+		"TopicName", t.TopicName, 
+		"CreaterID", t.CreaterID, 
+		"MsgServerAddr", t.MsgServerAddr, 
+		"Mode", t.Mode, 
+		"BanList", banList, 
+		"InviteList", inviteList, 
+		"PendingList", pendingList, 
+		"MaxAge", int64(t.MaxAge))
+	conn.Send("EXPIRE", self.key(t.TopicName), int(ttl.Seconds()))
+	conn.Send("EXPIRE", self.membersKey(t.TopicName), int(ttl.Seconds()))
+	conn.Send("EXPIRE", self.memberInfoKey(t.TopicName), int(ttl.Seconds()))
+	return nil
+}
+
+// Add m to the topic, or update its role and msg_server if it is a member
+// already. The member set and the member info change together, and live as
+// long as the topic does.
+func (self *RedisTopicStore) AddMember(topicName string, m *Member) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	ttl, err := redis.Int(conn.Do("TTL", self.key(topicName)))
+	if err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		ttl = int(self.ttl(0).Seconds())
+	}
+	conn.Send("MULTI")
+	err = self.SendAddMember(conn, topicName, m)
+	if err != nil {
+		conn.Do("DISCARD")
+		return err
+	}
+	conn.Send("EXPIRE", self.membersKey(topicName), ttl)
+	conn.Send("EXPIRE", self.memberInfoKey(topicName), ttl)
+	_, err = conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Queue the commands that add m to the topic on conn, so that they can run
+// in the MULTI of the caller. The TTL is left to the caller.
+func (self *RedisTopicStore) SendAddMember(conn redis.Conn, topicName string, m *Member) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	conn.Send("SADD", self.membersKey(topicName), m.ID)
+	conn.Send("HSET", self.memberInfoKey(topicName), m.ID, b)
+	return nil
+}
+
+// Remove id from the topic.
+func (self *RedisTopicStore) RemoveMember(topicName string, id string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SREM", self.membersKey(topicName), id)
+	conn.Send("HDEL", self.memberInfoKey(topicName), id)
+	_, err := conn.Do("EXEC")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Check whether id is a member of the topic.
+func (self *RedisTopicStore) IsMember(topicName string, id string) (bool, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	return redis.Bool(conn.Do("SISMEMBER", self.membersKey(topicName), id))
+}
+
+// Get the number of members of the topic.
+func (self *RedisTopicStore) CountMembers(topicName string) (int, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	return redis.Int(conn.Do("SCARD", self.membersKey(topicName)))
+}
+
+// Get the member id of the topic, or nil if id is not a member.
+func (self *RedisTopicStore) GetMember(topicName string, id string) (*Member, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	b, err := redis.Bytes(conn.Do("HGET", self.memberInfoKey(topicName), id))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeMember(id, b)
+}
+
+// Get a page of about count members of the topic, starting at cursor. The
+// first page starts at cursor 0, and the next cursor is 0 after the last page.
+func (self *RedisTopicStore) ScanMembers(topicName string, cursor uint64, count int) ([]*Member, uint64, error) {
+	conn := self.RS.Get()
+	defer conn.Close()
+	reply, err := redis.Values(conn.Do("SSCAN", self.membersKey(topicName), cursor, "COUNT", count))
+	if err != nil {
+		return nil, 0, err
+	}
+	next, err := redis.Uint64(reply[0], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	ids, err := redis.Strings(reply[1], nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	members := make([]*Member, 0, len(ids))
+	if len(ids) == 0 {
+		return members, next, nil
+	}
+	args := redis.Args{}.Add(self.memberInfoKey(topicName)).AddFlat(ids)
+	infos, err := redis.ByteSlices(conn.Do("HMGET", args...))
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, id := range ids {
+		m, err := decodeMember(id, infos[i])
+		if err != nil {
+			return nil, 0, err
+		}
+		members = append(members, m)
+	}
+	return members, next, nil
+}
+
+// Decode the info of the member id. A member without info is a publisher.
+func decodeMember(id string, b []byte) (*Member, error) {
+	m := NewMember(id)
+	if b == nil {
+		return m, nil
+	}
+	err := json.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+	m.ID = id
+	return m, nil
+}
+
+// Delete the topic and its members from the store.
+func (self *RedisTopicStore) Delete(id string) error {
+	conn := self.RS.Get()
+	defer conn.Close()
+	_, err := conn.Do("DEL", self.key(id), self.membersKey(id), self.memberInfoKey(id))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Get a page of about count topic names, starting at cursor. See
+// RedisStore.ScanKeys.
+func (self *RedisTopicStore) Scan(cursor uint64, count int) ([]string, uint64, error) {
+	return self.RS.ScanKeys(NS_TOPIC, cursor, count)
+}
+
+// Clear all topics and their members from the store, a page at a time.
+func (self *RedisTopicStore) Clear() error {
+	// Scan borrows a connection of its own, so one is only held per page
+	return ScanEach(self.Scan, DEFAULT_SCAN_COUNT, func(topicNames []string) error {
+		conn := self.RS.Get()
+		defer conn.Close()
+		conn.Send("MULTI")
+		for _, topicName := range topicNames {
+			conn.Send("DEL", self.key(topicName), self.membersKey(topicName), self.memberInfoKey(topicName))
+		}
+		_, err := conn.Do("EXEC")
+		return err
+	})
+}
+
+// Get the number of topics in the store, or -1 on error.
+func (self *RedisTopicStore) Len() int {
+	return scanLen(self.Scan)
+}